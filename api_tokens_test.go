@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"s3-drive/internal/database"
+)
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/api/files", database.ScopeRead},
+		{"HEAD", "/api/download", database.ScopeRead},
+		{"GET", "/api/trash", database.ScopeRead},
+		{"POST", "/api/upload/init", database.ScopeWrite},
+		{"POST", "/api/move", database.ScopeWrite},
+		{"POST", "/api/delete", database.ScopeDelete},
+		{"POST", "/api/soft-delete", database.ScopeDelete},
+		{"POST", "/api/trash/empty", database.ScopeDelete},
+		{"DELETE", "/api/shares", database.ScopeDelete},
+		{"GET", "/api/admin/users", database.ScopeAdmin},
+		{"POST", "/api/admin/users/update", database.ScopeAdmin},
+		// Never with a token, whatever its scopes
+		{"GET", "/api/tokens", ""},
+		{"POST", "/api/tokens/revoke", ""},
+		{"GET", "/api/sessions", ""},
+		{"POST", "/api/logout-all", ""},
+		{"POST", "/api/2fa/setup", ""},
+		{"POST", "/api/account/password", ""},
+		{"POST", "/api/admin/update-password", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := requiredScope(r); got != tt.want {
+				t.Errorf("requiredScope = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	testServer(t)
+
+	user := database.User{Username: "ci", Role: database.RoleUser}
+	database.DB.Create(&user)
+	_, readOnly, err := database.CreateAPIToken(user.ID, user.Role, "backup", []string{database.ScopeRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writer, _ := database.CreateAPIToken(user.ID, user.Role, "sync", []string{database.ScopeRead, database.ScopeWrite}, 0)
+
+	handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"read token lists files", readOnly, "GET", "/api/files", 200},
+		{"read token can't upload", readOnly, "POST", "/api/upload/init", 403},
+		{"write token uploads", writer, "POST", "/api/upload/init", 200},
+		{"write token can't delete", writer, "POST", "/api/delete", 403},
+		{"no token mints tokens", writer, "POST", "/api/tokens", 403},
+		{"unknown token", database.APITokenPrefix + "nope", "GET", "/api/files", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	// A token dies with its account
+	database.DB.Model(&user).Update("disabled", true)
+	r := httptest.NewRequest("GET", "/api/files", nil)
+	r.Header.Set("Authorization", "Bearer "+readOnly)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != 401 {
+		t.Errorf("token of a disabled account: status = %d, want 401", w.Code)
+	}
+}
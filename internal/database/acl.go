@@ -0,0 +1,349 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ACLEntry grants a user or a group a level on a file or folder. Grants on
+// a folder apply to everything below it.
+type ACLEntry struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	CreatedAt   int64  `json:"created_at"`
+	ItemID      uint   `gorm:"index" json:"item_id"`
+	SubjectType string `gorm:"index:idx_acl_subject" json:"subject_type"` // "user" or "group"
+	SubjectID   uint   `gorm:"index:idx_acl_subject" json:"subject_id"`
+	Level       string `json:"level"` // "viewer", "editor" or "owner"
+	GrantedBy   uint   `json:"granted_by"`
+
+	SubjectName string `gorm:"-" json:"subject_name"` // Username or group name, filled in for listings
+}
+
+const (
+	subjectUser  = "user"
+	subjectGroup = "group"
+)
+
+// Access levels, ordered: each one includes the ones below
+const (
+	levelNone = iota
+	levelViewer
+	levelEditor
+	levelOwner
+)
+
+var levelNames = map[string]int{"viewer": levelViewer, "editor": levelEditor, "owner": levelOwner}
+
+// --- THE PERMISSION CHECK ---
+// Everything that decides "may this caller see / change this item" goes through
+// accessLevel (single items) or accessFilter (queries). The rules:
+//   - admin: owner of everything
+//   - the item's creator, or the creator of any folder above it: owner
+//     (so what others add to your folder stays yours to manage)
+//   - ACL grants on the item or any folder above it
+//   - public items: guests may edit them (shared guest space), users may view them
+
+// baseLevel is everything except ACL grants
+func baseLevel(item FileMetadata, userID uint, role string) int {
+	if role == "admin" {
+		return levelOwner
+	}
+	level := levelNone
+	if role != "guest" && item.UserID != nil && *item.UserID == userID {
+		level = levelOwner
+	}
+	if item.IsPublic {
+		if role == "guest" {
+			level = max(level, levelEditor)
+		} else {
+			level = max(level, levelViewer)
+		}
+	}
+	return level
+}
+
+// grantsFor returns the best level granted to userID per item
+func grantsFor(userID uint, role string) map[uint]int {
+	grants := map[uint]int{}
+	if role == "guest" || userID == 0 {
+		return grants // Guests are one shared identity, nothing to grant to
+	}
+
+	var entries []ACLEntry
+	DB.Where(subjectCondition(userID)).Find(&entries)
+	for _, e := range entries {
+		grants[e.ItemID] = max(grants[e.ItemID], levelNames[e.Level])
+	}
+	return grants
+}
+
+// subjectCondition matches the ACL entries that apply to userID:
+// their own plus those of every group they're in
+func subjectCondition(userID uint) *gorm.DB {
+	return DB.Where("subject_type = ? AND subject_id = ?", subjectUser, userID).
+		Or("subject_type = ? AND subject_id IN (?)", subjectGroup, DB.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userID))
+}
+
+// ownsTree: creators own what's inside their folders too (guests own nothing)
+func ownsTree(item FileMetadata, userID uint, role string) bool {
+	return role != "guest" && userID != 0 && item.UserID != nil && *item.UserID == userID
+}
+
+// inheritedLevel is the best grant or ownership on item or any of its ancestors
+func inheritedLevel(item FileMetadata, userID uint, role string, grants map[uint]int) int {
+	if role == "guest" || userID == 0 {
+		return levelNone
+	}
+	level := grants[item.ID]
+	if ownsTree(item, userID, role) {
+		return levelOwner
+	}
+	cur := item
+	for steps := 0; cur.ParentID != nil && steps <= maxFolderDepth+1; steps++ {
+		level = max(level, grants[*cur.ParentID])
+		var parent FileMetadata
+		if err := DB.First(&parent, *cur.ParentID).Error; err != nil {
+			break
+		}
+		if ownsTree(parent, userID, role) {
+			return levelOwner
+		}
+		cur = parent
+	}
+	return level
+}
+
+// accessLevel is what userID may do with item
+func accessLevel(item FileMetadata, userID uint, role string) int {
+	level := baseLevel(item, userID, role)
+	if level == levelOwner {
+		return level
+	}
+	return max(level, inheritedLevel(item, userID, role, grantsFor(userID, role)))
+}
+
+// subtreeAccess computes levels while walking down from root (walkSubtree
+// order: parents before children), without re-walking the ancestors per item.
+type subtreeAccess struct {
+	userID    uint
+	role      string
+	grants    map[uint]int
+	inherited map[uint]int
+}
+
+func newSubtreeAccess(root FileMetadata, userID uint, role string) *subtreeAccess {
+	sa := &subtreeAccess{userID: userID, role: role, grants: grantsFor(userID, role), inherited: map[uint]int{}}
+	sa.inherited[root.ID] = inheritedLevel(root, userID, role, sa.grants)
+	return sa
+}
+
+func (sa *subtreeAccess) level(item FileMetadata) int {
+	inherited, ok := sa.inherited[item.ID]
+	if !ok {
+		inherited = sa.grants[item.ID]
+		if item.ParentID != nil {
+			inherited = max(inherited, sa.inherited[*item.ParentID])
+		}
+		if ownsTree(item, sa.userID, sa.role) {
+			inherited = levelOwner
+		}
+		sa.inherited[item.ID] = inherited
+	}
+	return max(baseLevel(item, sa.userID, sa.role), inherited)
+}
+
+// Helper: Who can see (and so download or copy) an item
+func canRead(file FileMetadata, userID uint, role string) bool {
+	return accessLevel(file, userID, role) >= levelViewer
+}
+
+// Helper: Who can change or delete an item (editors and up)
+func canDelete(file FileMetadata, userID uint, role string) bool {
+	return accessLevel(file, userID, role) >= levelEditor
+}
+
+// Writing follows the same rules as deleting
+func canWrite(file FileMetadata, userID uint, role string) bool {
+	return canDelete(file, userID, role)
+}
+
+// accessFilter limits a FileMetadata query to what shows up in the caller's
+// listings: own, public and shared items, plus whatever others put in your folders.
+// Admins get the same view (so their drive isn't flooded with everyone's files)
+// but canRead lets them open anything.
+// Grants and folder ownership reach down the tree through a recursive CTE
+// (SQLite and Postgres both have them).
+func accessFilter(query *gorm.DB, userID uint, role string) *gorm.DB {
+	if role == "guest" || userID == 0 {
+		return query.Where("is_public = ?", true)
+	}
+
+	granted := DB.Raw(`WITH RECURSIVE granted(id) AS (
+			SELECT item_id FROM acl_entries WHERE (subject_type = ? AND subject_id = ?)
+				OR (subject_type = ? AND subject_id IN (SELECT group_id FROM group_members WHERE user_id = ?))
+			UNION
+			SELECT id FROM file_metadata WHERE user_id = ? AND is_folder = ? AND deleted_at IS NULL
+			UNION
+			SELECT f.id FROM file_metadata f JOIN granted g ON f.parent_id = g.id WHERE f.deleted_at IS NULL
+		) SELECT id FROM granted`, subjectUser, userID, subjectGroup, userID, userID, true)
+
+	return query.Where("user_id = ? OR is_public = ? OR id IN (?)", userID, true, granted)
+}
+
+// CanWriteFolder checks the caller may add items to parentID (nil = their root)
+func CanWriteFolder(parentID *uint, userID uint, role string) error {
+	if parentID == nil {
+		return nil
+	}
+	var parent FileMetadata
+	if err := DB.First(&parent, *parentID).Error; err != nil || parent.IsTrash {
+		return errors.New("parent folder not found")
+	}
+	if !parent.IsFolder {
+		return errors.New("parent is not a folder")
+	}
+	if !canWrite(parent, userID, role) {
+		return errors.New("permission denied: cannot write to this folder")
+	}
+	return nil
+}
+
+// GetReadableItem loads an item the caller is allowed to see
+func GetReadableItem(id uint, userID uint, role string) (*FileMetadata, error) {
+	var item FileMetadata
+	if err := DB.First(&item, id).Error; err != nil || !canRead(item, userID, role) {
+		return nil, errors.New("item not found")
+	}
+	return &item, nil
+}
+
+// --- MANAGING GRANTS (owners only) ---
+
+// resetCache drops every cached listing: a grant changes what someone else sees
+func resetCache() {
+	cacheMutex.Lock()
+	cache = make(map[string][]FileMetadata)
+	cacheMutex.Unlock()
+}
+
+func ownedItem(itemID uint, userID uint, role string) (*FileMetadata, error) {
+	var item FileMetadata
+	if err := DB.First(&item, itemID).Error; err != nil {
+		return nil, errors.New("item not found")
+	}
+	if accessLevel(item, userID, role) < levelOwner {
+		return nil, errors.New("permission denied: owner access required")
+	}
+	return &item, nil
+}
+
+// ListGrants returns the grants set directly on an item
+func ListGrants(itemID uint, userID uint, role string) ([]ACLEntry, error) {
+	if _, err := ownedItem(itemID, userID, role); err != nil {
+		return nil, err
+	}
+
+	var entries []ACLEntry
+	if err := DB.Where("item_id = ?", itemID).Order("created_at asc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	fillSubjectNames(entries)
+	return entries, nil
+}
+
+func fillSubjectNames(entries []ACLEntry) {
+	for i := range entries {
+		if entries[i].SubjectType == subjectGroup {
+			var group Group
+			if DB.Select("name").First(&group, entries[i].SubjectID).Error == nil {
+				entries[i].SubjectName = group.Name
+			}
+			continue
+		}
+		var user User
+		if DB.Select("username").First(&user, entries[i].SubjectID).Error == nil {
+			entries[i].SubjectName = user.Username
+		}
+	}
+}
+
+// Grant gives a user or a group (subjectType "user" / "group", looked up by
+// name) a level on an item, replacing an earlier grant to the same subject
+func Grant(itemID uint, subjectType string, name string, level string, userID uint, role string) (*ACLEntry, error) {
+	if _, ok := levelNames[level]; !ok {
+		return nil, errors.New("level must be viewer, editor or owner")
+	}
+	item, err := ownedItem(itemID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := ACLEntry{ItemID: item.ID, SubjectType: subjectType}
+	switch subjectType {
+	case subjectUser:
+		var grantee User
+		if err := DB.Where("username = ?", name).First(&grantee).Error; err != nil {
+			return nil, errors.New("user not found")
+		}
+		if item.UserID != nil && *item.UserID == grantee.ID {
+			return nil, errors.New("user already owns this item")
+		}
+		entry.SubjectID = grantee.ID
+	case subjectGroup:
+		var group Group
+		if err := DB.Where("name = ?", name).First(&group).Error; err != nil {
+			return nil, errors.New("group not found")
+		}
+		entry.SubjectID = group.ID
+	default:
+		return nil, errors.New("grant to a user or a group")
+	}
+
+	DB.Where(&entry).Limit(1).Find(&entry)
+	entry.Level = level
+	entry.GrantedBy = userID
+	if entry.CreatedAt == 0 {
+		entry.CreatedAt = time.Now().Unix()
+	}
+	if err := DB.Save(&entry).Error; err != nil {
+		return nil, err
+	}
+
+	entry.SubjectName = name
+	resetCache()
+	return &entry, nil
+}
+
+// RevokeGrant removes one grant; the item's owners can do that
+func RevokeGrant(entryID uint, userID uint, role string) error {
+	var entry ACLEntry
+	if err := DB.First(&entry, entryID).Error; err != nil {
+		return errors.New("grant not found")
+	}
+	if _, err := ownedItem(entry.ItemID, userID, role); err != nil {
+		return err
+	}
+
+	if err := DB.Delete(&entry).Error; err != nil {
+		return err
+	}
+	resetCache()
+	return nil
+}
+
+// SharedWithMe lists the items granted directly to the caller or their groups
+// (a shared folder's contents are browsed from there)
+func SharedWithMe(userID uint, role string) ([]FileMetadata, error) {
+	var files []FileMetadata
+	if role == "guest" || userID == 0 {
+		return files, nil
+	}
+
+	err := DB.Where("is_trash = ? AND status = ?", false, "completed").
+		Where("id IN (?)", DB.Model(&ACLEntry{}).Select("item_id").Where(subjectCondition(userID))).
+		Order("is_folder desc, name asc").
+		Find(&files).Error
+	return files, err
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// APIToken is a long-lived personal access token for scripts and CI.
+// Only its SHA-256 is stored; the token itself is shown once, on creation.
+type APIToken struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	CreatedAt  int64  `json:"created_at"`
+	UserID     uint   `gorm:"index" json:"user_id"`
+	Name       string `json:"name"`
+	Prefix     string `json:"prefix"` // First characters, to tell tokens apart in listings
+	TokenHash  string `gorm:"uniqueIndex" json:"-"`
+	Scopes     string `json:"scopes"`     // "read,write,delete,admin" (any subset)
+	ExpiresAt  int64  `json:"expires_at"` // Unix seconds, 0 = never
+	LastUsedAt int64  `json:"last_used_at"`
+}
+
+// APITokenPrefix marks personal tokens, so authMiddleware can tell them from JWTs
+const APITokenPrefix = "s3d_"
+
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin"
+)
+
+var apiScopes = map[string]bool{ScopeRead: true, ScopeWrite: true, ScopeDelete: true, ScopeAdmin: true}
+
+var ErrTokenInvalid = errors.New("invalid or expired API token")
+
+func hashAPIToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken issues a token for the caller and returns it with the raw
+// token string (the only time it's available)
+func CreateAPIToken(userID uint, role string, name string, scopes []string, expiresAt int64) (*APIToken, string, error) {
+	if role == "guest" || userID == 0 {
+		return nil, "", errors.New("guests cannot create API tokens")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, "", errors.New("a name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	seen := map[string]bool{}
+	for _, s := range scopes {
+		if !apiScopes[s] {
+			return nil, "", errors.New("scopes must be read, write, delete or admin")
+		}
+		if s == ScopeAdmin && role != RoleAdmin {
+			return nil, "", errors.New("only admins can create admin tokens")
+		}
+		seen[s] = true
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return nil, "", errors.New("expiry must be in the future")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	raw := APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	var clean []string
+	for _, s := range []string{ScopeRead, ScopeWrite, ScopeDelete, ScopeAdmin} {
+		if seen[s] {
+			clean = append(clean, s)
+		}
+	}
+
+	token := APIToken{
+		CreatedAt: time.Now().Unix(), UserID: userID, Name: name,
+		Prefix: raw[:len(APITokenPrefix)+6], TokenHash: hashAPIToken(raw),
+		Scopes: strings.Join(clean, ","), ExpiresAt: expiresAt,
+	}
+	if err := DB.Create(&token).Error; err != nil {
+		return nil, "", err
+	}
+	return &token, raw, nil
+}
+
+func ListAPITokens(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := DB.Where("user_id = ?", userID).Order("created_at desc").Find(&tokens).Error
+	return tokens, err
+}
+
+func RevokeAPIToken(id uint, userID uint) error {
+	result := DB.Where("id = ? AND user_id = ?", id, userID).Delete(&APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("token not found")
+	}
+	return nil
+}
+
+// AuthenticateAPIToken looks a raw token up and records its use
+func AuthenticateAPIToken(raw string) (*APIToken, error) {
+	var token APIToken
+	DB.Where("token_hash = ?", hashAPIToken(raw)).Limit(1).Find(&token)
+	if token.ID == 0 {
+		return nil, ErrTokenInvalid
+	}
+
+	now := time.Now().Unix()
+	if token.ExpiresAt != 0 && now >= token.ExpiresAt {
+		return nil, ErrTokenInvalid
+	}
+	if now-token.LastUsedAt >= 60 { // A write per minute is plenty for "last used"
+		DB.Model(&token).Update("last_used_at", now)
+	}
+	return &token, nil
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	return strings.Contains(","+t.Scopes+",", ","+scope+",")
+}
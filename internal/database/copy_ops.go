@@ -0,0 +1,191 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"s3-drive/internal/storage"
+)
+
+// Object copies in flight at once
+const copyConcurrency = 4
+
+// CopyItem duplicates a file or a whole folder tree into destID (nil = root).
+// New rows get new uploads/<uuid> keys and the bytes are copied inside the
+// store. Rows stay 'pending' until every object is there, so a half-done
+// copy never shows up in listings.
+func CopyItem(id uint, destID *uint, userID uint, role string) (*FileMetadata, error) {
+	var src FileMetadata
+	if err := DB.First(&src, id).Error; err != nil {
+		return nil, errors.New("item not found")
+	}
+	if src.IsTrash || src.Status != "completed" || !canRead(src, userID, role) {
+		return nil, errors.New("item not found")
+	}
+
+	// 1. Validate the destination
+	rootDepth := 0
+	if destID != nil {
+		var dest FileMetadata
+		if err := DB.First(&dest, *destID).Error; err != nil {
+			return nil, errors.New("destination folder not found")
+		}
+		if !dest.IsFolder || dest.IsTrash {
+			return nil, errors.New("destination is not a folder")
+		}
+		if !canWrite(dest, userID, role) {
+			return nil, errors.New("permission denied: cannot write to destination")
+		}
+		rootDepth = dest.Depth + 1
+	}
+
+	// 2. Collect what to copy (skipping trash, unfinished uploads and what the caller can't see)
+	var nodes []FileMetadata
+	depths := map[uint]int{src.ID: rootDepth}
+	access := newSubtreeAccess(src, userID, role)
+	err := walkSubtree(src, func(current FileMetadata) error {
+		if current.ID != src.ID {
+			if current.IsTrash || current.Status != "completed" || access.level(current) < levelViewer {
+				return nil
+			}
+			if _, ok := depths[*current.ParentID]; !ok {
+				return nil // Parent was skipped
+			}
+			depths[current.ID] = depths[*current.ParentID] + 1
+		}
+
+		if destID != nil && current.ID == *destID {
+			return errors.New("cannot copy a folder into itself")
+		}
+		if current.IsFolder && depths[current.ID] > maxFolderDepth {
+			return fmt.Errorf("max folder depth (%d) reached", maxFolderDepth)
+		}
+		nodes = append(nodes, current)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The copies count against the caller's quota
+	var copyBytes, copyFiles int64
+	for _, n := range nodes {
+		if !n.IsFolder {
+			copyBytes += n.Size
+			copyFiles++
+		}
+	}
+	if err := CheckQuota(userID, role, copyBytes, copyFiles); err != nil {
+		return nil, err
+	}
+
+	// 3. Create the new rows (pending), parents first
+	var ownerPtr *uint
+	if userID != 0 {
+		ownerPtr = &userID
+	}
+
+	newIDs := map[uint]uint{}
+	var created []FileMetadata
+	type copyJob struct{ src, dst string }
+	var jobs []copyJob
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for _, n := range nodes {
+			clone := FileMetadata{
+				Name:     n.Name,
+				Size:     n.Size,
+				MimeType: n.MimeType,
+				UserID:   ownerPtr,
+				IsPublic: role == "guest", // Same rule as uploads
+				Status:   "pending",
+				IsFolder: n.IsFolder,
+				Depth:    depths[n.ID],
+			}
+
+			if n.ID == src.ID {
+				clone.ParentID = destID
+				if sameParent(src.ParentID, destID) {
+					clone.Name = "Copy of " + n.Name
+				}
+			} else {
+				parent := newIDs[*n.ParentID]
+				clone.ParentID = &parent
+			}
+
+			if !n.IsFolder {
+				clone.S3Key = fmt.Sprintf("uploads/%s", uuid.New().String())
+				clone.ETag = n.ETag
+				jobs = append(jobs, copyJob{src: n.S3Key, dst: clone.S3Key})
+			}
+
+			if err := tx.Create(&clone).Error; err != nil {
+				return err
+			}
+			newIDs[n.ID] = clone.ID
+			created = append(created, clone)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(created))
+	for _, c := range created {
+		ids = append(ids, c.ID)
+	}
+
+	// 4. Copy the bytes (inside the store, never through us)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, copyConcurrency)
+	)
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := storage.Store.CopyObject(job.src, job.dst); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		// Roll back: drop the rows and queue whatever did get copied
+		var keys []string
+		for _, job := range jobs {
+			keys = append(keys, job.dst)
+		}
+		BatchDelete(ids, keys)
+		WakeDeletionWorker()
+		return nil, fmt.Errorf("copy failed: %w", firstErr)
+	}
+
+	// 5. Everything landed, show it
+	for start := 0; start < len(ids); start += 500 {
+		batch := ids[start:min(start+500, len(ids))]
+		if err := DB.Model(&FileMetadata{}).Where("id IN ?", batch).Update("status", "completed").Error; err != nil {
+			return nil, err
+		}
+	}
+
+	InvalidateCache(destID, userID)
+
+	root := created[0]
+	root.Status = "completed"
+	return &root, nil
+}
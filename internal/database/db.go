@@ -16,6 +16,22 @@ type User struct {
 	ID       uint   `gorm:"primaryKey" json:"id"`
 	Username string `gorm:"uniqueIndex" json:"username"`
 	Password string `json:"-"` 
+	Role     string `json:"role"` // "admin" or "user"
+	Disabled bool   `gorm:"default:false" json:"disabled"`
+	QuotaBytes *int64 `json:"quota_bytes,omitempty"` // nil = role default (QUOTA_* env), 0 = unlimited
+	QuotaFiles *int64 `json:"quota_files,omitempty"`
+	CreatedAt int64 `json:"created_at"`
+
+	Email       string  `gorm:"index" json:"email,omitempty"`
+	OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex" json:"-"` // "sub" at the OIDC provider, set once the account is linked
+
+	TOTPEnabled  bool   `gorm:"column:totp_enabled;default:false" json:"totp_enabled"`
+	TOTPSecret   string `gorm:"column:totp_secret" json:"-"` // Base32; set on enrollment, active once TOTPEnabled
+	TOTPLastStep int64  `gorm:"column:totp_last_step" json:"-"` // Last accepted 30s step, so a code works once
+
+	FailedLogins int   `gorm:"column:failed_logins;default:0" json:"-"` // Wrong passwords (any IP) since the last login
+	FailedCodes  int   `gorm:"column:failed_codes;default:0" json:"-"`  // Wrong 2FA codes since the last login
+	LockedUntil  int64 `gorm:"column:locked_until;default:0" json:"-"`  // Unix time, logins refused until then
 }
 
 type FileMetadata struct {
@@ -28,10 +44,22 @@ type FileMetadata struct {
 	S3Key    string `json:"-"`
 	Size     int64  `json:"size"`
 	MimeType string `json:"mime_type"`
+	ETag     string `gorm:"column:etag" json:"etag,omitempty"` // From the store, set when the upload is verified
 	
 	UserID   *uint  `gorm:"index" json:"user_id,omitempty"` 
 	IsPublic bool   `gorm:"default:false" json:"is_public"` 
 	Status string `json:"status" gorm:"default:'pending'"`
+	UploadID string `json:"-"` // S3 multipart upload ID while a big upload is in flight
+	PartSize int64  `json:"-"` // Chunk size it was planned with (needed to resume)
+	ReplacesID *uint `json:"-"` // Pending upload that becomes a new version of this file
+
+	FileRequestID *uint  `gorm:"index" json:"-"` // Dropped in through this file request link
+	UploaderName  string `json:"uploader_name,omitempty"`  // Supplied by the (anonymous) uploader of a drop
+	UploaderEmail string `json:"uploader_email,omitempty"`
+
+	Version   int   `gorm:"default:1" json:"version"`
+	VersionBy *uint `json:"-"` // Uploader of the current version (UserID stays the owner)
+	VersionAt int64 `json:"-"` // When the current version was uploaded, 0 = CreatedAt
 
 	IsFolder bool   `gorm:"default:false" json:"is_folder"`
 	ParentID *uint  `gorm:"index" json:"parent_id"`
@@ -39,6 +67,9 @@ type FileMetadata struct {
 	
 	IsStarred bool `gorm:"default:false" json:"is_starred"`
 	IsTrash   bool `gorm:"default:false" json:"is_trash"`
+	TrashRootID *uint `gorm:"index" json:"-"` // The item whose trashing put this one in Trash
+	TrashedAt   int64 `gorm:"index" json:"trashed_at,omitempty"` // Unix seconds, drives the retention purge
+	TrashedBy   *uint `gorm:"index" json:"-"` // Who trashed it (an editor's deletes show up in their Trash too)
 }
 
 var DB *gorm.DB
@@ -62,11 +93,14 @@ func Connect() {
 		log.Fatal("❌ Failed to connect to database:", err)
 	}
 
-	err = DB.AutoMigrate(&User{}, &FileMetadata{})
+	err = DB.AutoMigrate(&User{}, &FileMetadata{}, &PendingDeletion{}, &FileVersion{}, &ShareLink{}, &FileRequest{}, &Setting{}, &ACLEntry{}, &Group{}, &GroupMember{}, &APIToken{}, &Session{}, &RecoveryCode{}, &LoginFailure{})
 	if err != nil {
 		log.Fatal("❌ Database migration failed:", err)
 	}
 
+	// Before roles existed every account logged in as admin, keep it that way
+	DB.Model(&User{}).Where("role IS NULL OR role = ''").Update("role", RoleAdmin)
+
 	log.Println("✅ Database connected and migrated")
 }
 
@@ -85,13 +119,35 @@ func StartCleanupTask() {
             // Calculate 24 hours ago (Unix Timestamp)
             yesterday := time.Now().Add(-24 * time.Hour).Unix()
 
-            // Delete rows where Status='pending' AND CreatedAt < yesterday
-            result := DB.Where("status = ? AND created_at < ?", "pending", yesterday).Delete(&FileMetadata{})
-            
-            if result.Error != nil {
-                log.Printf("❌ Cleanup Failed: %v\n", result.Error)
+            purgeExpiredSessions()
+            purgeLoginFailures()
+
+            // Resumable (multipart) uploads get a week since they were last touched
+            abortStaleMultipartUploads(time.Now().Add(-multipartResumeWindow).Unix())
+
+            // Find rows where Status='pending' (or 'failed') AND CreatedAt < yesterday
+            var zombies []FileMetadata
+            DB.Where("status IN ? AND created_at < ?", []string{"pending", "failed"}, yesterday).
+                Where("COALESCE(upload_id, '') = ''").
+                Find(&zombies)
+
+            // Their PUT may have landed anyway, so queue the objects too
+            var ids []uint
+            var keys []string
+            for _, z := range zombies {
+                ids = append(ids, z.ID)
+                if z.S3Key != "" { // Folders (e.g. from an interrupted copy) have no object
+                    keys = append(keys, z.S3Key)
+                }
+            }
+
+            if len(ids) == 0 {
+                log.Println("✅ Cleanup Complete. Nothing to remove.")
+            } else if err := BatchDelete(ids, keys); err != nil {
+                log.Printf("❌ Cleanup Failed: %v\n", err)
             } else {
-                log.Printf("✅ Cleanup Complete. Removed %d zombie records.\n", result.RowsAffected)
+                WakeDeletionWorker()
+                log.Printf("✅ Cleanup Complete. Removed %d zombie records.\n", len(ids))
             }
         }
     }
@@ -27,33 +27,27 @@ func GetDeletionCandidates(targetID uint, userID uint, role string) (*DeleteResu
 	}
 
 	// 2. BFS Traversal (Find all descendants)
-	queue := []FileMetadata{target}
-
-	for len(queue) > 0 {
-		current := queue[0]
-		queue = queue[1:] // Pop
+	access := newSubtreeAccess(target, userID, role)
+	err := walkSubtree(target, func(current FileMetadata) error {
+		// 🛑 SECURITY CHECK (Recursive)
+		if current.ID != target.ID && access.level(current) < levelEditor {
+			return errors.New("aborting: folder contains protected admin files")
+		}
 
 		// Add to deletion list
 		dbIds = append(dbIds, current.ID)
 		if !current.IsFolder {
 			s3Keys = append(s3Keys, current.S3Key)
 		}
-
-		// If it's a folder, find children
-		if current.IsFolder {
-			var children []FileMetadata
-			DB.Where("parent_id = ?", current.ID).Find(&children)
-
-			for _, child := range children {
-				// 🛑 SECURITY CHECK (Recursive)
-				if !canDelete(child, userID, role) {
-					return nil, errors.New("aborting: folder contains protected admin files")
-				}
-				queue = append(queue, child)
-			}
-		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	// Old versions go with their file
+	s3Keys = append(s3Keys, versionKeys(dbIds)...)
+
 	return &DeleteResult{
 		S3Keys:       s3Keys,
 		DBIds:        dbIds,
@@ -61,29 +55,50 @@ func GetDeletionCandidates(targetID uint, userID uint, role string) (*DeleteResu
 	}, nil
 }
 
-// Helper: Defines the Rules
-func canDelete(file FileMetadata, userID uint, role string) bool {
-	// Rule 1: Admin can delete EVERYTHING
-	if role == "admin" {
-		return true
+// HardDelete permanently removes an item and its subtree: rows now (in one
+// transaction with the deletion queue), S3 objects via the deletion worker.
+func HardDelete(targetID uint, userID uint, role string) (*DeleteResult, error) {
+	// 1. Calculate what needs to be deleted
+	candidates, err := GetDeletionCandidates(targetID, userID, role)
+	if err != nil {
+		return nil, err
 	}
 
-	// Rule 2: Guests can ONLY delete Public items
-	if role == "guest" {
-		return file.IsPublic
+	// 2. Delete from DB, queueing the S3 objects in the same transaction
+	if err := BatchDelete(candidates.DBIds, candidates.S3Keys); err != nil {
+		return nil, errors.New("database error")
 	}
 
-	// Rule 3: Standard Users can only delete their own
-	if file.UserID != nil && *file.UserID == userID {
-		return true
-	}
+	// 3. Delete from S3 (Batch) in the background, retried until the bucket agrees
+	WakeDeletionWorker()
+
+	// 4. Invalidate Cache! Forces the file list to refresh on the next request
+	InvalidateCache(candidates.RootParentID, userID)
 
-	return false
+	return candidates, nil
 }
 
-// Actual DB Deletion
-// Actual DB Deletion
-func BatchDelete(ids []uint) error {
-    // Unscoped() tells GORM: "Ignore the DeletedAt column and actually remove the row"
-    return DB.Unscoped().Delete(&FileMetadata{}, ids).Error
-}
\ No newline at end of file
+// walkSubtree visits root and then every descendant, breadth first.
+// Stops at the first error returned by visit.
+func walkSubtree(root FileMetadata, visit func(FileMetadata) error) error {
+	queue := []FileMetadata{root}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:] // Pop
+
+		if err := visit(current); err != nil {
+			return err
+		}
+
+		// If it's a folder, find children
+		if current.IsFolder {
+			var children []FileMetadata
+			if err := DB.Where("parent_id = ?", current.ID).Find(&children).Error; err != nil {
+				return err
+			}
+			queue = append(queue, children...)
+		}
+	}
+	return nil
+}
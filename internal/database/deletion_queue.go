@@ -0,0 +1,145 @@
+package database
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"s3-drive/internal/storage"
+)
+
+// PendingDeletion is an S3 object whose row is already gone.
+// Written in the same transaction as the row delete, drained by StartDeletionWorker.
+type PendingDeletion struct {
+	ID            uint `gorm:"primaryKey"`
+	CreatedAt     int64
+	S3Key         string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt int64 `gorm:"index"` // Unix seconds, backoff after failures
+	LastError     string
+}
+
+const (
+	deletionPollInterval = 1 * time.Minute
+	deletionBatchSize    = 1000
+	deletionMaxBackoff   = 6 * time.Hour
+)
+
+// Lets handleDelete kick the worker instead of waiting for the next poll
+var deletionWake = make(chan struct{}, 1)
+
+// WakeDeletionWorker asks the worker to drain the queue now (never blocks)
+func WakeDeletionWorker() {
+	select {
+	case deletionWake <- struct{}{}:
+	default: // Already woken
+	}
+}
+
+// BatchDelete removes the rows for good and queues their S3 objects
+// for deletion, both in one transaction: the bucket can lag behind the
+// DB but never lose track of an object.
+func BatchDelete(ids []uint, s3Keys []string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if len(s3Keys) > 0 {
+			now := time.Now().Unix()
+			queue := make([]PendingDeletion, 0, len(s3Keys))
+			for _, k := range s3Keys {
+				queue = append(queue, PendingDeletion{S3Key: k, NextAttemptAt: now})
+			}
+			if err := tx.CreateInBatches(queue, 500).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("file_id IN ?", ids).Delete(&FileVersion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id IN ?", ids).Delete(&ShareLink{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("folder_id IN ?", ids).Delete(&FileRequest{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("item_id IN ?", ids).Delete(&ACLEntry{}).Error; err != nil {
+			return err
+		}
+
+		// Unscoped() tells GORM: "Ignore the DeletedAt column and actually remove the row"
+		return tx.Unscoped().Delete(&FileMetadata{}, ids).Error
+	})
+}
+
+// StartDeletionWorker drains pending_deletions forever in the background
+func StartDeletionWorker() {
+	ticker := time.NewTicker(deletionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there are full batches due
+		for drainDeletions() == deletionBatchSize {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deletionWake:
+		}
+	}
+}
+
+// drainDeletions handles one batch of due keys and returns how many it picked up
+func drainDeletions() int {
+	now := time.Now()
+
+	var due []PendingDeletion
+	if err := DB.Where("next_attempt_at <= ?", now.Unix()).
+		Order("id asc").Limit(deletionBatchSize).Find(&due).Error; err != nil {
+		log.Printf("❌ Deletion queue: %v\n", err)
+		return 0
+	}
+	if len(due) == 0 {
+		return 0
+	}
+
+	keys := make([]string, 0, len(due))
+	for _, d := range due {
+		keys = append(keys, d.S3Key)
+	}
+
+	result, _ := storage.Store.DeleteMultiple(keys)
+
+	failed := make(map[string]error, len(result.Failed))
+	for _, f := range result.Failed {
+		failed[f.Key] = f.Err
+	}
+
+	var done []uint
+	for _, d := range due {
+		err, bad := failed[d.S3Key]
+		if !bad {
+			done = append(done, d.ID)
+			continue
+		}
+
+		// Exponential backoff: 1m, 2m, 4m ... capped at 6h
+		backoff := deletionPollInterval << min(d.Attempts, 20)
+		if backoff > deletionMaxBackoff {
+			backoff = deletionMaxBackoff
+		}
+		DB.Model(&d).Updates(map[string]interface{}{
+			"attempts":        d.Attempts + 1,
+			"next_attempt_at": now.Add(backoff).Unix(),
+			"last_error":      err.Error(),
+		})
+	}
+
+	if len(done) > 0 {
+		DB.Delete(&PendingDeletion{}, done)
+	}
+	if len(failed) > 0 {
+		log.Printf("⚠️ Deletion queue: %d deleted, %d will be retried\n", len(done), len(failed))
+	}
+
+	return len(due)
+}
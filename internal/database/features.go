@@ -1,6 +1,12 @@
 package database
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 // --- 1. SEARCH ---
 func SearchFiles(query string, page int, userID uint, role string) ([]FileMetadata, error) {
@@ -10,17 +16,7 @@ func SearchFiles(query string, page int, userID uint, role string) ([]FileMetada
 	db := DB.Where("is_trash = ?", false). // Don't search inside trash
 		Where("name LIKE ?", "%"+query+"%") // Partial match
 
-	if role != "admin" {
-		// Guest: Public only. User: Own files only.
-		if userID == 0 {
-			db = db.Where("is_public = ?", true)
-		} else {
-			db = db.Where("user_id = ?", userID)
-		}
-	} else {
-		// Admin sees everything (or restrict to own? assuming own + public for now)
-		db = db.Where("user_id = ? OR is_public = ?", userID, true)
-	}
+	db = accessFilter(db, userID, role)
 
 	// Order by relevance (folder matches first, then files)
 	err := db.Order("is_folder desc, name asc").
@@ -37,13 +33,7 @@ func GetRecents(page int, userID uint, role string) ([]FileMetadata, error) {
 
 	db := DB.Where("is_trash = ?", false).Where("is_folder = ?", false) // Usually recents are files, not folders
 
-	if role == "guest" {
-		db = db.Where("is_public = ?", true)
-	} else if role == "admin" {
-		db = db.Where("user_id = ? OR is_public = ?", userID, true)
-	} else {
-		db = db.Where("user_id = ?", userID)
-	}
+	db = accessFilter(db, userID, role)
 
 	err := db.Order("created_at desc"). // Newest first
 		Limit(50).Offset(offset).
@@ -59,11 +49,7 @@ func GetStarred(page int, userID uint, role string) ([]FileMetadata, error) {
 
 	db := DB.Where("is_trash = ?", false).Where("is_starred = ?", true)
 
-	if role == "guest" {
-		db = db.Where("is_public = ?", true)
-	} else {
-		db = db.Where("user_id = ?", userID)
-	}
+	db = accessFilter(db, userID, role)
 
 	err := db.Order("created_at desc").
 		Limit(50).Offset(offset).
@@ -73,13 +59,13 @@ func GetStarred(page int, userID uint, role string) ([]FileMetadata, error) {
 }
 
 // Toggle Star Status
-func ToggleStar(id uint, userID uint) (bool, error) {
+func ToggleStar(id uint, userID uint, role string) (bool, error) {
 	var file FileMetadata
 	if err := DB.First(&file, id).Error; err != nil {
 		return false, err
 	}
 
-	if file.UserID != nil && *file.UserID != userID && userID != 1 {
+	if !canWrite(file, userID, role) {
 		return false, fmt.Errorf("permission denied")
 	}
 
@@ -94,16 +80,17 @@ func ToggleStar(id uint, userID uint) (bool, error) {
 }
 
 // --- 4. TRASH (SOFT DELETE) ---
-func GetTrash(page int, userID uint) ([]FileMetadata, error) {
+func GetTrash(page int, userID uint, role string) ([]FileMetadata, error) {
 	var files []FileMetadata
 	offset := (page - 1) * 50
 
-	// Everyone sees their own trash. 
+	// Everyone sees their own trash, plus what they trashed in folders shared with them.
 	// Admin sees all? Let's stick to "Own Trash" for safety.
-	db := DB.Where("is_trash = ?", true)
+	// Only top-level entries: the contents of a trashed folder come back with it
+	db := trashEntries()
 	
 	if userID != 0 {
-		db = db.Where("user_id = ?", userID)
+		db = db.Where("user_id = ? OR trashed_by = ?", userID, userID)
 	} else {
 		// Guest trash? (If we allow guests to soft delete public files, that's chaotic)
 		// Let's assume Guests can't use Trash for now, or only for sessions.
@@ -111,21 +98,133 @@ func GetTrash(page int, userID uint) ([]FileMetadata, error) {
 		return []FileMetadata{}, nil
 	}
 
-	err := db.Order("updated_at desc"). // Recently trashed first
+	err := db.Order("trashed_at desc"). // Recently trashed first
 		Limit(50).Offset(offset).
 		Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
 
-	return files, err
+	// Someone else's item stays listed only while the caller could still restore it
+	visible := []FileMetadata{}
+	for _, f := range files {
+		if (f.UserID != nil && *f.UserID == userID) || canDelete(f, userID, role) {
+			visible = append(visible, f)
+		}
+	}
+	return visible, nil
 }
 
-func SoftDelete(id uint, userID uint) error {
-	// Move to Trash
-	return DB.Model(&FileMetadata{}).Where("id = ? AND user_id = ?", id, userID).
-		Update("is_trash", true).Error
+// SoftDelete moves an item to Trash (editors and up, like HardDelete). For a folder
+// the whole subtree goes with it, tagged with the folder's ID so restoring brings back exactly that.
+func SoftDelete(id uint, userID uint, role string) (*FileMetadata, error) {
+	if role == "guest" || userID == 0 {
+		return nil, errors.New("guests cannot use trash")
+	}
+	var root FileMetadata
+	if err := DB.First(&root, id).Error; err != nil {
+		return nil, errors.New("item not found")
+	}
+	if !canDelete(root, userID, role) {
+		return nil, errors.New("permission denied")
+	}
+	if root.IsTrash {
+		return nil, errors.New("item is already in trash")
+	}
+
+	// Items trashed on their own earlier keep their own trash entry
+	var ids []uint
+	err := walkSubtree(root, func(current FileMetadata) error {
+		if current.ID == root.ID || !current.IsTrash {
+			ids = append(ids, current.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(ids); start += 500 {
+			batch := ids[start:min(start+500, len(ids))]
+			if err := tx.Model(&FileMetadata{}).Where("id IN ?", batch).
+				Updates(map[string]interface{}{"is_trash": true, "trash_root_id": root.ID, "trashed_at": now, "trashed_by": userID}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return &root, err
 }
 
-func RestoreFromTrash(id uint, userID uint) error {
-	// Move out of Trash
-	return DB.Model(&FileMetadata{}).Where("id = ? AND user_id = ?", id, userID).
-		Update("is_trash", false).Error
-}
\ No newline at end of file
+// RestoreFromTrash brings back an item and everything that was trashed with it
+// (editors and up). If its old parent is gone or still in Trash, it is restored to root instead.
+func RestoreFromTrash(id uint, userID uint, role string) (*FileMetadata, error) {
+	if role == "guest" || userID == 0 {
+		return nil, errors.New("guests cannot use trash")
+	}
+	var root FileMetadata
+	if err := DB.Where("id = ? AND is_trash = ?", id, true).First(&root).Error; err != nil {
+		return nil, errors.New("item not found in trash")
+	}
+	if !canDelete(root, userID, role) {
+		return nil, errors.New("item not found in trash")
+	}
+	// Only whole trash entries can be restored, not a file deep inside a trashed folder
+	if root.TrashRootID != nil && *root.TrashRootID != root.ID {
+		return nil, errors.New("item was trashed with its folder, restore the folder instead")
+	}
+
+	// Where does it go back to?
+	toRoot := false
+	if root.ParentID != nil {
+		var parent FileMetadata
+		if err := DB.First(&parent, *root.ParentID).Error; err != nil || parent.IsTrash {
+			toRoot = true
+		}
+	}
+
+	// Moving to root shifts the whole subtree up, including items trashed separately
+	var subtree []uint
+	if toRoot && root.Depth > 0 {
+		err := walkSubtree(root, func(current FileMetadata) error {
+			subtree = append(subtree, current.ID)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// Legacy rows (before recursive trash) have no trash_root_id
+		if err := tx.Model(&FileMetadata{}).Where("id = ? OR trash_root_id = ?", root.ID, root.ID).
+			Updates(map[string]interface{}{"is_trash": false, "trash_root_id": nil, "trashed_at": 0, "trashed_by": nil}).Error; err != nil {
+			return err
+		}
+
+		if !toRoot {
+			return nil
+		}
+		if err := tx.Model(&root).Update("parent_id", nil).Error; err != nil {
+			return err
+		}
+		for start := 0; start < len(subtree); start += 500 {
+			batch := subtree[start:min(start+500, len(subtree))]
+			if err := tx.Model(&FileMetadata{}).Where("id IN ?", batch).
+				Update("depth", gorm.Expr("depth - ?", root.Depth)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if toRoot {
+		root.ParentID = nil
+	}
+	return &root, nil
+}
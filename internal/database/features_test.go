@@ -0,0 +1,60 @@
+package database
+
+import "testing"
+
+func TestTrashedByEditor(t *testing.T) {
+	testDB(t)
+
+	alice := seedUser(t, "alice", RoleUser)
+	editor := seedUser(t, "eddie", RoleUser)
+	other := seedUser(t, "mallory", RoleUser)
+	shared := seedItem(t, FileMetadata{Name: "shared", IsFolder: true, UserID: &alice.ID})
+	doc := seedItem(t, FileMetadata{Name: "doc.txt", S3Key: "uploads/d", UserID: &alice.ID, ParentID: &shared.ID, Depth: 1})
+	grant := ACLEntry{ItemID: shared.ID, SubjectType: subjectUser, SubjectID: editor.ID, Level: "editor"}
+	DB.Create(&grant)
+
+	inTrash := func(userID uint) bool {
+		t.Helper()
+		files, err := GetTrash(1, userID, RoleUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if f.ID == doc.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	if _, err := SoftDelete(doc.ID, editor.ID, RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if !inTrash(editor.ID) || !inTrash(alice.ID) {
+		t.Fatal("trashed item missing from the editor's or the owner's Trash")
+	}
+	if inTrash(other.ID) {
+		t.Error("trashed item shows up for an unrelated user")
+	}
+
+	if _, err := RestoreFromTrash(doc.ID, editor.ID, RoleUser); err != nil {
+		t.Fatalf("editor restoring what they trashed: %v", err)
+	}
+	if inTrash(editor.ID) || inTrash(alice.ID) {
+		t.Error("restored item still in Trash")
+	}
+
+	// Once the grant is gone, the editor can't restore it, so they don't see it either
+	if _, err := SoftDelete(doc.ID, editor.ID, RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeGrant(grant.ID, alice.ID, RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if inTrash(editor.ID) {
+		t.Error("item still listed for the editor after their access was revoked")
+	}
+	if !inTrash(alice.ID) {
+		t.Error("owner lost the item from their Trash")
+	}
+}
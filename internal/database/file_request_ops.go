@@ -0,0 +1,253 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"s3-drive/internal/storage"
+)
+
+// FileRequest is an upload-only link into a folder: visitors can drop files
+// in, but never see what's there. Dropped files belong to the link's creator.
+type FileRequest struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	Token     string `gorm:"uniqueIndex" json:"token"`
+	FolderID  uint   `gorm:"index" json:"folder_id"`
+	UserID    *uint  `gorm:"index" json:"user_id,omitempty"` // Who created the link (owns the uploads)
+	Title     string `json:"title"`                          // Shown to the uploader
+
+	MaxFileSize       int64  `json:"max_file_size"`      // Bytes per file, 0 = up to MaxSinglePutSize
+	MaxFiles          int    `json:"max_files"`          // 0 = unlimited
+	AllowedExtensions string `json:"allowed_extensions"` // "pdf,docx", empty = anything
+	ExpiresAt         int64  `json:"expires_at"`         // Unix seconds, 0 = never
+
+	Uploads int64 `gorm:"-" json:"uploads"` // Files received so far (pending included)
+}
+
+var (
+	ErrRequestNotFound = errors.New("file request not found")
+	ErrRequestExpired  = errors.New("file request has expired")
+	ErrRequestFull     = errors.New("file request has reached its file limit")
+)
+
+// normalizeExtensions turns "PDF, .docx" into "pdf,docx"
+func normalizeExtensions(exts []string) string {
+	var clean []string
+	for _, e := range exts {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e != "" {
+			clean = append(clean, e)
+		}
+	}
+	return strings.Join(clean, ",")
+}
+
+// CreateFileRequest opens a drop link on a folder the caller can write to
+func CreateFileRequest(folderID uint, userID uint, role string, title string, maxFileSize int64, maxFiles int, extensions []string, expiresAt int64) (*FileRequest, error) {
+	if role == "guest" {
+		return nil, errors.New("guests cannot create file requests")
+	}
+	if maxFileSize < 0 || maxFiles < 0 {
+		return nil, errors.New("limits cannot be negative")
+	}
+	if maxFileSize > storage.MaxSinglePutSize {
+		return nil, errors.New("max file size cannot exceed 5GB")
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return nil, errors.New("expiry must be in the future")
+	}
+
+	var folder FileMetadata
+	if err := DB.First(&folder, folderID).Error; err != nil || folder.IsTrash || !folder.IsFolder {
+		return nil, errors.New("folder not found")
+	}
+	if !canWrite(folder, userID, role) {
+		return nil, errors.New("permission denied")
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req := FileRequest{
+		Token: token, FolderID: folder.ID, Title: strings.TrimSpace(title),
+		MaxFileSize: maxFileSize, MaxFiles: maxFiles,
+		AllowedExtensions: normalizeExtensions(extensions), ExpiresAt: expiresAt,
+	}
+	if userID != 0 {
+		req.UserID = &userID
+	}
+
+	if err := DB.Create(&req).Error; err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// ListFileRequests returns the caller's drop links (admin: everyone's)
+func ListFileRequests(userID uint, role string) ([]FileRequest, error) {
+	query := DB.Model(&FileRequest{})
+	if role != "admin" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var reqs []FileRequest
+	if err := query.Order("created_at desc").Find(&reqs).Error; err != nil {
+		return nil, err
+	}
+	for i := range reqs {
+		reqs[i].Uploads = countDrops(DB, reqs[i].ID)
+	}
+	return reqs, nil
+}
+
+// RevokeFileRequest closes a drop link. Files already dropped stay.
+func RevokeFileRequest(id uint, userID uint, role string) error {
+	query := DB.Where("id = ?", id)
+	if role != "admin" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	result := query.Delete(&FileRequest{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRequestNotFound
+	}
+	return nil
+}
+
+// countDrops counts files received through a link, pending ones included
+// (abandoned uploads free their slot when the cleanup task removes them)
+func countDrops(db *gorm.DB, requestID uint) int64 {
+	var n int64
+	db.Model(&FileMetadata{}).Where("file_request_id = ? AND status IN ?", requestID, []string{"pending", "completed"}).Count(&n)
+	return n
+}
+
+// OpenFileRequest checks a drop token: it must exist, not be expired and its
+// folder must still be there.
+func OpenFileRequest(token string) (*FileRequest, *FileMetadata, error) {
+	var req FileRequest
+	if token != "" {
+		DB.Where("token = ?", token).Limit(1).Find(&req)
+	}
+	if req.ID == 0 {
+		return nil, nil, ErrRequestNotFound
+	}
+	if req.ExpiresAt != 0 && time.Now().Unix() >= req.ExpiresAt {
+		return nil, nil, ErrRequestExpired
+	}
+
+	var folder FileMetadata
+	if err := DB.First(&folder, req.FolderID).Error; err != nil || folder.IsTrash {
+		return nil, nil, ErrRequestNotFound
+	}
+	// The link only works while its creator could still open it (and owns what arrives)
+	if !creatorCanDrop(&req, folder) {
+		return nil, nil, ErrRequestNotFound
+	}
+
+	req.Uploads = countDrops(DB, req.ID)
+	return &req, &folder, nil
+}
+
+// creatorCanDrop re-checks CreateFileRequest's rule with the creator's current access
+func creatorCanDrop(req *FileRequest, folder FileMetadata) bool {
+	if req.UserID == nil {
+		return false
+	}
+	creator, err := ActiveUser(*req.UserID)
+	if err != nil {
+		return false
+	}
+	return canWrite(folder, creator.ID, creator.Role)
+}
+
+// NewDrop validates one file against a drop link's rules and returns the
+// pending row to create for it (the caller saves it with CreatePending, which
+// checks the file limit and the quota again, and hands out the URL).
+func NewDrop(token string, filename string, size int64, uploaderName string, uploaderEmail string) (*FileMetadata, error) {
+	req, folder, err := OpenFileRequest(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. The file
+	if filename, err = CleanName(filename); err != nil {
+		return nil, errors.New("invalid file name")
+	}
+	if size <= 0 {
+		return nil, errors.New("size must be positive")
+	}
+	limit := req.MaxFileSize
+	if limit == 0 {
+		limit = storage.MaxSinglePutSize
+	}
+	if size > limit {
+		return nil, fmt.Errorf("file too large (max %d bytes)", limit)
+	}
+	if req.AllowedExtensions != "" {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+		if !strings.Contains(","+req.AllowedExtensions+",", ","+ext+",") {
+			return nil, fmt.Errorf("file type not allowed (allowed: %s)", req.AllowedExtensions)
+		}
+	}
+
+	// 2. Who sent it
+	uploaderName = strings.TrimSpace(uploaderName)
+	uploaderEmail = strings.TrimSpace(uploaderEmail)
+	if uploaderName == "" || len(uploaderName) > 255 {
+		return nil, errors.New("your name is required")
+	}
+	if uploaderEmail != "" {
+		addr, err := mail.ParseAddress(uploaderEmail)
+		if err != nil || len(uploaderEmail) > 255 {
+			return nil, errors.New("invalid email address")
+		}
+		uploaderEmail = addr.Address
+	}
+
+	// 3. Room left
+	if req.MaxFiles > 0 && req.Uploads >= int64(req.MaxFiles) {
+		return nil, ErrRequestFull
+	}
+
+	// 4. Room left in the owner's quota
+	if err := CheckOwnerQuota(req.UserID, size, 1); err != nil {
+		return nil, err
+	}
+
+	return &FileMetadata{
+		Name: filename, Size: size,
+		UserID: req.UserID, IsPublic: folder.IsPublic,
+		ParentID: &folder.ID, Depth: folder.Depth + 1,
+		Status:        "pending",
+		FileRequestID: &req.ID,
+		UploaderName:  uploaderName,
+		UploaderEmail: uploaderEmail,
+	}, nil
+}
+
+// GetPendingDrop loads an in-flight upload made through this drop link
+func GetPendingDrop(token string, fileID uint) (*FileMetadata, error) {
+	req, _, err := OpenFileRequest(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var file FileMetadata
+	if err := DB.Where("id = ? AND status = ? AND file_request_id = ?", fileID, "pending", req.ID).First(&file).Error; err != nil {
+		return nil, errors.New("upload not found")
+	}
+	return &file, nil
+}
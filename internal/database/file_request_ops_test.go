@@ -0,0 +1,80 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestFileRequestDrops(t *testing.T) {
+	testDB(t)
+
+	alice := seedUser(t, "alice", RoleUser)
+	editor := seedUser(t, "eddie", RoleUser)
+	inbox := seedItem(t, FileMetadata{Name: "inbox", IsFolder: true, UserID: &alice.ID})
+	grant := ACLEntry{ItemID: inbox.ID, SubjectType: subjectUser, SubjectID: editor.ID, Level: "editor"}
+	DB.Create(&grant)
+
+	t.Run("parallel drops stay within the file limit", func(t *testing.T) {
+		req, err := CreateFileRequest(inbox.ID, alice.ID, RoleUser, "CVs", 0, 3, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// All ten pass NewDrop's early check before any is saved: the worst interleaving
+		var drops []*FileMetadata
+		for i := 0; i < 10; i++ {
+			file, err := NewDrop(req.Token, fmt.Sprintf("cv%d.pdf", i), 100, "Sam", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.S3Key = fmt.Sprintf("uploads/cv%d", i)
+			drops = append(drops, file)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		created, full := 0, 0
+		for i, file := range drops {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := CreatePending(file)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					created++
+				case errors.Is(err, ErrRequestFull):
+					full++
+				default:
+					t.Errorf("drop %d: %v", i, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if created != 3 || full != 7 {
+			t.Errorf("created %d, refused %d; want 3 and 7", created, full)
+		}
+	})
+
+	t.Run("link dies with its creator's access", func(t *testing.T) {
+		req, err := CreateFileRequest(inbox.ID, editor.ID, RoleUser, "", 0, 0, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := OpenFileRequest(req.Token); err != nil {
+			t.Fatalf("while granted: %v", err)
+		}
+		if err := RevokeGrant(grant.ID, alice.ID, RoleUser); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := OpenFileRequest(req.Token); !errors.Is(err, ErrRequestNotFound) {
+			t.Errorf("after the grant is revoked: err = %v, want ErrRequestNotFound", err)
+		}
+		if _, err := NewDrop(req.Token, "late.pdf", 100, "Sam", ""); !errors.Is(err, ErrRequestNotFound) {
+			t.Errorf("drop after the grant is revoked: err = %v, want ErrRequestNotFound", err)
+		}
+	})
+}
@@ -3,8 +3,11 @@ package database
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // --- SIMPLE IN-MEMORY CACHE ---
@@ -23,27 +26,24 @@ func InvalidateCache(parentID *uint, userID uint) {
 		pID = fmt.Sprintf("%d", *parentID)
 	}
 
-	// 1. Clear the specific user's cache (Standard behavior)
-	key := fmt.Sprintf("%s_%d", pID, userID)
-	delete(cache, key)
-
-	// 2. THE FIX: If this was a Guest action (UserID 0), or if it affected a Public folder,
-	// we must ALSO clear the Admin's cache for this folder.
-	// Since we don't track "which admin", we can just clear the specific admin ID (1) 
-	// or loop through all keys starting with pID.
-	
-	// Simple Fix: Always clear Admin (ID 1) cache for this folder too.
-	adminKey := fmt.Sprintf("%s_%d", pID, 1)
-	delete(cache, adminKey)
-	
-	// Bonus: If Admin did something public, clear Guest (ID 0) too.
-	guestKey := fmt.Sprintf("%s_%d", pID, 0)
-	delete(cache, guestKey)
+	// Clear the folder for EVERY user: a public item (or an admin acting on
+	// someone else's file) changes what other users see too.
+	prefix := pID + "_"
+	for key := range cache {
+		if strings.HasPrefix(key, prefix) {
+			delete(cache, key)
+		}
+	}
 }
 
 // --- FOLDER OPERATIONS ---
 
 func CreateFolder(name string, parentID *uint, userID uint, isPublic bool) (*FileMetadata, error) {
+	name, err := CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+
 	// 1. Calculate Depth & Validate Parent
 	currentDepth := 0
 	
@@ -55,8 +55,8 @@ func CreateFolder(name string, parentID *uint, userID uint, isPublic bool) (*Fil
 		if !parentFolder.IsFolder {
 			return nil, errors.New("parent is not a folder")
 		}
-		if parentFolder.Depth >= 10 {
-			return nil, errors.New("max folder depth (10) reached")
+		if parentFolder.Depth >= maxFolderDepth {
+			return nil, fmt.Errorf("max folder depth (%d) reached", maxFolderDepth)
 		}
 		currentDepth = parentFolder.Depth + 1
 	}
@@ -89,7 +89,32 @@ func CreateFolder(name string, parentID *uint, userID uint, isPublic bool) (*Fil
 	return &folder, nil
 }
 
+// folderQuery selects the visible (completed, not trashed) children of parentID,
+// without any permission filter. Callers add their own.
+func folderQuery(parentID *uint) *gorm.DB {
+	query := DB.Where("status = ?", "completed").Where("is_trash = ?", false)
+
+	// Parent Filter
+	if parentID == nil {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", *parentID)
+	}
+	return query
+}
+
+var ErrFolderNotFound = errors.New("folder not found")
+
 func GetFolderContent(parentID *uint, userID uint, role string) ([]FileMetadata, error) {
+	// 0. The folder itself must be readable (checked before the cache: access can
+	// change without this listing changing, e.g. a shared folder moved away)
+	if parentID != nil {
+		var folder FileMetadata
+		if err := DB.First(&folder, *parentID).Error; err != nil || !folder.IsFolder || !canRead(folder, userID, role) {
+			return nil, ErrFolderNotFound
+		}
+	}
+
 	// 1. GENERATE CACHE KEY
 	pID := "root"
 	if parentID != nil { pID = fmt.Sprintf("%d", *parentID) }
@@ -105,23 +130,10 @@ func GetFolderContent(parentID *uint, userID uint, role string) ([]FileMetadata,
 
 	// 3. DATABASE QUERY (Cache Miss)
 	var files []FileMetadata
-	//query := DB.Where("status = ?", "completed")
-	query := DB.Where("status = ?", "completed").Where("is_trash = ?", false)
-
-	// Parent Filter
-	if parentID == nil {
-		query = query.Where("parent_id IS NULL")
-	} else {
-		query = query.Where("parent_id = ?", *parentID)
-	}
+	query := folderQuery(parentID)
 
 	// Permission Filter
-	if role == "admin" {
-		query = query.Where("user_id = ? OR is_public = ?", userID, true)
-	} else {
-		// Guests can only see Public stuff
-		query = query.Where("is_public = ?", true)
-	}
+	query = accessFilter(query, userID, role)
 
 	err := query.Order("is_folder desc, name asc").Find(&files).Error
 	
@@ -133,4 +145,152 @@ func GetFolderContent(parentID *uint, userID uint, role string) ([]FileMetadata,
 	}
 
 	return files, err
-}
\ No newline at end of file
+}
+// --- RENAME / MOVE ---
+
+// Max depth of a folder (root level = 0), same limit CreateFolder enforces
+const maxFolderDepth = 10
+
+// CleanName trims a file or folder name and rejects what would turn into a
+// path when downloaded or zipped ("..", slashes, control characters)
+func CleanName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return "", errors.New("invalid name")
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return "", errors.New("invalid name")
+		}
+	}
+	return name, nil
+}
+
+func RenameItem(id uint, name string, userID uint, role string) (*FileMetadata, error) {
+	name, err := CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var item FileMetadata
+	if err := DB.First(&item, id).Error; err != nil {
+		return nil, errors.New("item not found")
+	}
+	if !canWrite(item, userID, role) {
+		return nil, errors.New("permission denied")
+	}
+
+	if err := DB.Model(&item).Update("name", name).Error; err != nil {
+		return nil, err
+	}
+
+	InvalidateCache(item.ParentID, userID)
+	return &item, nil
+}
+
+// MoveItem moves a file or folder (with its subtree) into destID (nil = root)
+func MoveItem(id uint, destID *uint, userID uint, role string) (*FileMetadata, error) {
+	var item FileMetadata
+	if err := DB.First(&item, id).Error; err != nil {
+		return nil, errors.New("item not found")
+	}
+	if item.IsTrash {
+		return nil, errors.New("item is in trash")
+	}
+	if !canWrite(item, userID, role) {
+		return nil, errors.New("permission denied")
+	}
+
+	// 1. Validate the destination
+	rootDepth := 0
+	if destID != nil {
+		var dest FileMetadata
+		if err := DB.First(&dest, *destID).Error; err != nil {
+			return nil, errors.New("destination folder not found")
+		}
+		if !dest.IsFolder || dest.IsTrash {
+			return nil, errors.New("destination is not a folder")
+		}
+		if !canWrite(dest, userID, role) {
+			return nil, errors.New("permission denied: cannot write to destination")
+		}
+
+		// Walk up from the destination: if we meet the item, it's our own descendant
+		for cur := &dest; ; {
+			if cur.ID == item.ID {
+				return nil, errors.New("cannot move a folder into itself")
+			}
+			if cur.ParentID == nil {
+				break
+			}
+			var parent FileMetadata
+			if err := DB.First(&parent, *cur.ParentID).Error; err != nil {
+				break
+			}
+			cur = &parent
+		}
+
+		rootDepth = dest.Depth + 1
+	}
+
+	oldParentID := item.ParentID
+	if sameParent(oldParentID, destID) {
+		return &item, nil // Nothing to do
+	}
+
+	// 2. Recompute Depth for the whole subtree (parents come before children in BFS)
+	depths := map[uint]int{item.ID: rootDepth}
+	byDepth := map[int][]uint{}
+	access := newSubtreeAccess(item, userID, role)
+	err := walkSubtree(item, func(current FileMetadata) error {
+		if current.ID != item.ID && access.level(current) < levelEditor {
+			return errors.New("aborting: folder contains protected admin files")
+		}
+		if current.ParentID != nil && current.ID != item.ID {
+			depths[current.ID] = depths[*current.ParentID] + 1
+		}
+		d := depths[current.ID]
+		if current.IsFolder && d > maxFolderDepth {
+			return fmt.Errorf("max folder depth (%d) reached", maxFolderDepth)
+		}
+		byDepth[d] = append(byDepth[d], current.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Apply
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&item).Update("parent_id", destID).Error; err != nil {
+			return err
+		}
+		for depth, ids := range byDepth {
+			for start := 0; start < len(ids); start += 500 {
+				batch := ids[start:min(start+500, len(ids))]
+				if err := tx.Model(&FileMetadata{}).Where("id IN ?", batch).Update("depth", depth).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. Not just both folders changed: grants inherited through the old parent
+	// no longer apply below item, so anyone's cached listing in there is stale
+	resetCache()
+
+	item.ParentID = destID
+	item.Depth = rootDepth
+	return &item, nil
+}
+
+func sameParent(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetFolderContentAccess(t *testing.T) {
+	testDB(t)
+
+	alice, bob, carol := uint(2), uint(3), uint(4)
+	shared := seedItem(t, FileMetadata{Name: "shared", IsFolder: true, UserID: &alice})
+	sub := seedItem(t, FileMetadata{Name: "sub", IsFolder: true, UserID: &alice, ParentID: &shared.ID, Depth: 1})
+	seedItem(t, FileMetadata{Name: "plan.txt", S3Key: "uploads/p", UserID: &alice, ParentID: &sub.ID, Depth: 2})
+	private := seedItem(t, FileMetadata{Name: "private", IsFolder: true, UserID: &alice})
+	file := seedItem(t, FileMetadata{Name: "loose.txt", S3Key: "uploads/l", UserID: &alice})
+	DB.Create(&ACLEntry{ItemID: shared.ID, SubjectType: subjectUser, SubjectID: bob, Level: "viewer"})
+
+	tests := []struct {
+		name    string
+		folder  uint
+		userID  uint
+		role    string
+		wantErr bool
+	}{
+		{"grantee lists a shared subfolder", sub.ID, bob, "user", false},
+		{"owner lists a private folder", private.ID, alice, "user", false},
+		{"admin lists a private folder", private.ID, 1, "admin", false},
+		{"unrelated user can't list a private folder", private.ID, carol, "user", true},
+		{"guest can't list a private folder", private.ID, 0, "guest", true},
+		{"grantee can't list outside the share", private.ID, bob, "user", true},
+		{"a file isn't a folder", file.ID, alice, "user", true},
+		{"missing folder", 9999, 1, "admin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GetFolderContent(&tt.folder, tt.userID, tt.role)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("moving a subtree out of a share drops the grantee's cached listings", func(t *testing.T) {
+		if files, err := GetFolderContent(&sub.ID, bob, "user"); err != nil || len(files) != 1 {
+			t.Fatalf("before the move: %d files, err %v", len(files), err)
+		}
+		if files, _ := GetFolderContent(&shared.ID, bob, "user"); len(files) != 1 {
+			t.Fatalf("shared lists %d items before the move, want 1", len(files))
+		}
+		if _, err := MoveItem(sub.ID, &private.ID, alice, "user"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetFolderContent(&sub.ID, bob, "user"); !errors.Is(err, ErrFolderNotFound) {
+			t.Errorf("after the move: err = %v, want ErrFolderNotFound", err)
+		}
+		if files, _ := GetFolderContent(&shared.ID, bob, "user"); len(files) != 0 {
+			t.Errorf("shared still lists %d items after the move", len(files))
+		}
+	})
+}
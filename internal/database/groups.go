@@ -0,0 +1,107 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Group is a named set of users ("design", "finance") that ACL grants can
+// target. Admins manage membership; a change applies to every grant at once.
+type Group struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	Name      string `gorm:"uniqueIndex" json:"name"`
+
+	Members int64 `gorm:"-" json:"members"` // Filled in for listings
+}
+
+type GroupMember struct {
+	GroupID uint `gorm:"primaryKey" json:"group_id"`
+	UserID  uint `gorm:"primaryKey;index" json:"user_id"`
+}
+
+func CreateGroup(name string) (*Group, error) {
+	name = strings.TrimSpace(name)
+	if !validUsername(name) {
+		return nil, errors.New("invalid group name")
+	}
+
+	var taken int64
+	DB.Model(&Group{}).Where("name = ?", name).Count(&taken)
+	if taken > 0 {
+		return nil, errors.New("group name already taken")
+	}
+
+	group := Group{Name: name, CreatedAt: time.Now().Unix()}
+	if err := DB.Create(&group).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func ListGroups() ([]Group, error) {
+	var groups []Group
+	if err := DB.Order("name asc").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		DB.Model(&GroupMember{}).Where("group_id = ?", groups[i].ID).Count(&groups[i].Members)
+	}
+	return groups, nil
+}
+
+// DeleteGroup removes a group, its memberships and every grant made to it
+func DeleteGroup(id uint) error {
+	var group Group
+	if err := DB.First(&group, id).Error; err != nil {
+		return errors.New("group not found")
+	}
+
+	DB.Where("group_id = ?", id).Delete(&GroupMember{})
+	DB.Where("subject_type = ? AND subject_id = ?", subjectGroup, id).Delete(&ACLEntry{})
+	if err := DB.Delete(&group).Error; err != nil {
+		return err
+	}
+	resetCache()
+	return nil
+}
+
+// ListGroupMembers returns the users in a group
+func ListGroupMembers(groupID uint) ([]User, error) {
+	var users []User
+	err := DB.Where("id IN (?)", DB.Model(&GroupMember{}).Select("user_id").Where("group_id = ?", groupID)).
+		Order("username asc").
+		Find(&users).Error
+	return users, err
+}
+
+func AddGroupMember(groupID uint, username string) error {
+	var group Group
+	if err := DB.First(&group, groupID).Error; err != nil {
+		return errors.New("group not found")
+	}
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		return errors.New("user not found")
+	}
+
+	member := GroupMember{GroupID: group.ID, UserID: user.ID}
+	if err := DB.Where(&member).FirstOrCreate(&member).Error; err != nil {
+		return err
+	}
+	resetCache() // The member now sees whatever the group was granted
+	return nil
+}
+
+func RemoveGroupMember(groupID uint, userID uint) error {
+	result := DB.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&GroupMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("not a member of this group")
+	}
+	resetCache()
+	return nil
+}
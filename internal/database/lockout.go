@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Failed logins are counted in the database, three ways:
+//   - wrong passwords per account and client IP: a stranger who only knows a
+//     username locks out their own IP, not the account's owner
+//   - wrong passwords per account from everywhere, at a much higher threshold
+//     (guessing spread over many IPs)
+//   - wrong 2FA codes per account: only reachable with the password, so a few
+//     are enough, whatever IP or challenge they come from
+//
+// Each locks for loginLockout; a complete login resets the counts.
+const (
+	maxFailedPasswords = 5   // Per account and IP
+	maxAccountFailures = 100 // Per account, all IPs together
+	maxFailedCodes     = 5   // 2FA codes per account
+	loginLockout       = 15 * time.Minute
+)
+
+var ErrLoginLocked = errors.New("too many failed attempts, try again in 15 minutes")
+
+// LoginFailure counts wrong passwords for one account from one client IP
+type LoginFailure struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      uint   `gorm:"uniqueIndex:idx_login_failure"`
+	IP          string `gorm:"column:ip;uniqueIndex:idx_login_failure"`
+	Failures    int    `gorm:"default:0"`
+	LockedUntil int64
+	UpdatedAt   int64 `gorm:"index"`
+}
+
+// loginLocked: the whole account, or just this IP for this account
+func loginLocked(user *User, ip string) bool {
+	now := time.Now().Unix()
+	if user.LockedUntil > now {
+		return true
+	}
+	if ip == "" {
+		return false
+	}
+	var n int64
+	DB.Model(&LoginFailure{}).Where("user_id = ? AND ip = ? AND locked_until > ?", user.ID, ip, now).Count(&n)
+	return n > 0
+}
+
+// lockAt counts one more failure in table.column; the last one allowed starts a
+// lockout. Columns are qualified so it also works as an upsert's DO UPDATE.
+// One statement each, so concurrent attempts can't slip past the count.
+func lockAt(table string, column string, limit int) map[string]interface{} {
+	count := table + "." + column
+	return map[string]interface{}{
+		column:         gorm.Expr("CASE WHEN "+count+" + 1 >= ? THEN 0 ELSE "+count+" + 1 END", limit),
+		"locked_until": gorm.Expr("CASE WHEN "+count+" + 1 >= ? THEN ? ELSE "+table+".locked_until END", limit, time.Now().Add(loginLockout).Unix()),
+	}
+}
+
+func recordFailedPassword(userID uint, ip string) {
+	now := time.Now().Unix()
+	updates := lockAt("login_failures", "failures", maxFailedPasswords)
+	updates["updated_at"] = now
+	DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "ip"}},
+		DoUpdates: clause.Assignments(updates),
+	}).Create(&LoginFailure{UserID: userID, IP: ip, Failures: 1, UpdatedAt: now})
+
+	DB.Model(&User{}).Where("id = ?", userID).Updates(lockAt("users", "failed_logins", maxAccountFailures))
+}
+
+func recordFailedCode(userID uint) {
+	DB.Model(&User{}).Where("id = ?", userID).Updates(lockAt("users", "failed_codes", maxFailedCodes))
+}
+
+// passwordOK: this IP proved it has the password, its own count starts over
+func passwordOK(userID uint, ip string) {
+	DB.Where("user_id = ? AND ip = ?", userID, ip).Delete(&LoginFailure{})
+}
+
+// loginComplete resets the account-wide counts
+func loginComplete(userID uint) {
+	DB.Model(&User{}).Where("id = ? AND (failed_logins > 0 OR failed_codes > 0)", userID).
+		Updates(map[string]interface{}{"failed_logins": 0, "failed_codes": 0})
+}
+
+// purgeLoginFailures forgets per-IP counts nobody added to for a day
+func purgeLoginFailures() {
+	DB.Where("updated_at < ? AND locked_until < ?", time.Now().Add(-24*time.Hour).Unix(), time.Now().Unix()).Delete(&LoginFailure{})
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedLoginUser adds an account with a cheap hash, so failed logins don't cost seconds each
+func seedLoginUser(t *testing.T, username string, password string) User {
+	t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	user := User{Username: username, Password: string(hash), Role: RoleUser}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestPasswordLockout(t *testing.T) {
+	testDB(t)
+
+	t.Run("per IP: the attacker's address is locked, not the owner", func(t *testing.T) {
+		seedLoginUser(t, "alice", "correct horse")
+		for i := 0; i < maxFailedPasswords; i++ {
+			if _, err := Authenticate("alice", "wrong", "203.0.113.9"); err == nil || errors.Is(err, ErrLoginLocked) {
+				t.Fatalf("attempt %d: err = %v, want invalid credentials", i+1, err)
+			}
+		}
+		if _, err := Authenticate("alice", "correct horse", "203.0.113.9"); !errors.Is(err, ErrLoginLocked) {
+			t.Errorf("attacker IP: err = %v, want ErrLoginLocked", err)
+		}
+		if _, err := Authenticate("alice", "correct horse", "198.51.100.1"); err != nil {
+			t.Errorf("owner's IP: err = %v, want a login", err)
+		}
+	})
+
+	t.Run("the right password resets its IP's count", func(t *testing.T) {
+		seedLoginUser(t, "bob", "correct horse")
+		for i := 0; i < maxFailedPasswords-1; i++ {
+			Authenticate("bob", "wrong", "192.0.2.1")
+		}
+		Authenticate("bob", "correct horse", "192.0.2.1")
+		if _, err := Authenticate("bob", "wrong", "192.0.2.1"); errors.Is(err, ErrLoginLocked) {
+			t.Fatal("locked right after a good login")
+		}
+		if _, err := Authenticate("bob", "correct horse", "192.0.2.1"); err != nil {
+			t.Errorf("err = %v, want a login", err)
+		}
+	})
+
+	t.Run("guessing spread over many IPs locks the account", func(t *testing.T) {
+		seedLoginUser(t, "carol", "correct horse")
+		for i := 0; i < maxAccountFailures; i++ {
+			Authenticate("carol", "wrong", fmt.Sprintf("10.0.%d.%d", i/250, i%250))
+		}
+		if _, err := Authenticate("carol", "correct horse", "198.51.100.1"); !errors.Is(err, ErrLoginLocked) {
+			t.Errorf("err = %v, want ErrLoginLocked", err)
+		}
+	})
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	testDB(t)
+
+	secret := []byte("12345678901234567890")
+	user := User{Username: "alice", Role: RoleUser, TOTPEnabled: true, TOTPSecret: b32.EncodeToString(secret)}
+	DB.Create(&user)
+	code := func() string { return totpCode(secret, time.Now().Unix()/totpPeriod) }
+
+	for i := 0; i < maxFailedCodes; i++ {
+		if err := CheckSecondFactor(user.ID, "000000"); !errors.Is(err, ErrTOTPInvalid) {
+			t.Fatalf("attempt %d: err = %v, want ErrTOTPInvalid", i+1, err)
+		}
+	}
+	// Locked now: even the right code is refused, from any IP
+	if err := CheckSecondFactor(user.ID, code()); !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("err = %v, want ErrLoginLocked", err)
+	}
+	if _, err := Authenticate("alice", "anything", "198.51.100.1"); !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("password step err = %v, want ErrLoginLocked", err)
+	}
+
+	// Once the lockout ran out a good code gets in and resets the count
+	DB.Model(&user).Update("locked_until", time.Now().Add(-time.Second).Unix())
+	CheckSecondFactor(user.ID, "000000")
+	if err := CheckSecondFactor(user.ID, code()); err != nil {
+		t.Fatalf("err = %v after the lockout", err)
+	}
+	DB.First(&user, user.ID)
+	if user.FailedCodes != 0 {
+		t.Errorf("FailedCodes = %d after a good code, want 0", user.FailedCodes)
+	}
+}
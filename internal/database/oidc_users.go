@@ -0,0 +1,105 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// OIDCUser finds or provisions the account behind an OIDC login:
+//  1. an account already linked to this subject
+//  2. an unlinked account whose email (set by an admin) matches the
+//     provider-verified one, which gets linked
+//  3. a new account, named after preferred_username or the email
+//
+// role ("admin" / "user", from the provider's groups) is applied on every
+// login; "" leaves it alone (new accounts get "user").
+func OIDCUser(subject string, email string, emailVerified bool, preferredUsername string, role string) (*User, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("identity has no subject")
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	var user User
+	DB.Where("oidc_subject = ?", subject).Limit(1).Find(&user)
+
+	if user.ID == 0 && email != "" && emailVerified {
+		DB.Where("LOWER(email) = ? AND oidc_subject IS NULL", email).Limit(1).Find(&user)
+		if user.ID != 0 {
+			if err := DB.Model(&user).Update("oidc_subject", subject).Error; err != nil {
+				return nil, err
+			}
+			log.Printf("🔗 Linked user %s to OIDC subject %s\n", user.Username, subject)
+		}
+	}
+
+	if user.ID == 0 {
+		if role == "" {
+			role = RoleUser
+		}
+		user = User{
+			Username:    freeUsername(preferredUsername, email),
+			Role:        role,
+			OIDCSubject: &subject,
+			CreatedAt:   time.Now().Unix(),
+		} // No password: this account logs in through the provider only
+		if emailVerified {
+			user.Email, _ = cleanEmail(email, 0) // Unverified addresses could claim someone else's
+		}
+		if err := DB.Create(&user).Error; err != nil {
+			return nil, err
+		}
+		log.Printf("👤 Created user %s from OIDC login\n", user.Username)
+	}
+
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	if role != "" && role != user.Role {
+		updated, err := UpdateUser(user.ID, &role, nil, nil)
+		if err != nil {
+			log.Printf("⚠️ OIDC role for %s not applied: %v\n", user.Username, err) // e.g. the last admin
+		} else {
+			user = *updated
+			user.Role = role
+		}
+	}
+	if email != "" && emailVerified && email != user.Email {
+		if clean, err := cleanEmail(email, user.ID); err == nil { // Another account may have it already
+			DB.Model(&user).Update("email", clean)
+		}
+	}
+	return &user, nil
+}
+
+// freeUsername turns a provider name into a valid username nobody has yet
+func freeUsername(preferred string, email string) string {
+	base := preferred
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+	base = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" /\\@:", r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(base))
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 56 {
+		base = base[:56]
+	}
+
+	name := base
+	for i := 2; ; i++ {
+		var taken int64
+		DB.Model(&User{}).Where("username = ?", name).Count(&taken)
+		if taken == 0 {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Usage is what an account (or the guest pool) stores, against its quota.
+// A quota of 0 means unlimited.
+type Usage struct {
+	UsedBytes  int64 `json:"used_bytes"`
+	UsedFiles  int64 `json:"used_files"`
+	QuotaBytes int64 `json:"quota_bytes"`
+	QuotaFiles int64 `json:"quota_files"`
+}
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// roleQuota reads QUOTA_<ROLE>_BYTES / QUOTA_<ROLE>_FILES (unset = unlimited).
+// For guests it's one quota shared by everyone using the guest login.
+func roleQuota(role string) (int64, int64) {
+	prefix := "QUOTA_USER"
+	switch role {
+	case "admin":
+		prefix = "QUOTA_ADMIN"
+	case "guest":
+		prefix = "QUOTA_GUEST"
+	}
+
+	bytes, _ := strconv.ParseInt(os.Getenv(prefix+"_BYTES"), 10, 64)
+	files, _ := strconv.ParseInt(os.Getenv(prefix+"_FILES"), 10, 64)
+	return max(bytes, 0), max(files, 0)
+}
+
+// quotaFor is the role default, overridden per user by an admin
+func quotaFor(db *gorm.DB, userID uint, role string) (int64, int64) {
+	bytes, files := roleQuota(role)
+	if role == "guest" || userID == 0 {
+		return bytes, files
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err == nil {
+		if user.QuotaBytes != nil {
+			bytes = *user.QuotaBytes
+		}
+		if user.QuotaFiles != nil {
+			files = *user.QuotaFiles
+		}
+	}
+	return bytes, files
+}
+
+// GetUsage adds up completed and pending files (pending ones have their bytes
+// reserved already), trash included, plus the old versions kept for them.
+// Guests share one pool: every row without an owner.
+func GetUsage(userID uint, role string) (*Usage, error) {
+	return usageOf(DB, userID, role)
+}
+
+// usageOf is GetUsage inside a transaction
+func usageOf(db *gorm.DB, userID uint, role string) (*Usage, error) {
+	owner := func(q *gorm.DB) *gorm.DB {
+		if role == "guest" || userID == 0 {
+			return q.Where("user_id IS NULL")
+		}
+		return q.Where("user_id = ?", userID)
+	}
+
+	var totals struct {
+		Bytes int64
+		Files int64
+	}
+	// Pending uploads count too (they reserve their space); sizes below 0 never lower the total
+	err := owner(db.Model(&FileMetadata{})).
+		Select("COALESCE(SUM(CASE WHEN size > 0 THEN size ELSE 0 END), 0) AS bytes, COUNT(*) AS files").
+		Where("is_folder = ? AND status IN ?", false, []string{"pending", "completed"}).
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var versionBytes int64
+	err = db.Model(&FileVersion{}).
+		Select("COALESCE(SUM(CASE WHEN size > 0 THEN size ELSE 0 END), 0)").
+		Where("file_id IN (?)", owner(db.Model(&FileMetadata{}).Select("id"))).
+		Scan(&versionBytes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &Usage{UsedBytes: totals.Bytes + versionBytes, UsedFiles: totals.Files}
+	usage.QuotaBytes, usage.QuotaFiles = quotaFor(db, userID, role)
+	return usage, nil
+}
+
+// CheckQuota fails if adding files files of bytes bytes would go over quota
+func CheckQuota(userID uint, role string, bytes int64, files int64) error {
+	return checkQuota(DB, userID, role, bytes, files)
+}
+
+func checkQuota(db *gorm.DB, userID uint, role string, bytes int64, files int64) error {
+	if bytes < 0 || files < 0 {
+		return errors.New("size must be positive")
+	}
+	usage, err := usageOf(db, userID, role)
+	if err != nil {
+		return err
+	}
+
+	if usage.QuotaBytes > 0 && usage.UsedBytes+bytes > usage.QuotaBytes {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, usage.UsedBytes, usage.QuotaBytes)
+	}
+	if usage.QuotaFiles > 0 && usage.UsedFiles+files > usage.QuotaFiles {
+		return fmt.Errorf("%w: %d of %d files used", ErrQuotaExceeded, usage.UsedFiles, usage.QuotaFiles)
+	}
+	return nil
+}
+
+// CheckOwnerQuota is CheckQuota for files that will belong to ownerID
+// (drops into someone's folder count against that someone)
+func CheckOwnerQuota(ownerID *uint, bytes int64, files int64) error {
+	return checkOwnerQuota(DB, ownerID, bytes, files)
+}
+
+// checkOwnerQuota locks the owner's row, so on Postgres two transactions
+// reserving space for the same account take turns
+func checkOwnerQuota(db *gorm.DB, ownerID *uint, bytes int64, files int64) error {
+	if ownerID == nil {
+		return checkQuota(db, 0, "guest", bytes, files)
+	}
+
+	var owner User
+	if err := db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&owner, *ownerID).Error; err != nil {
+		return errors.New("owner not found")
+	}
+	return checkQuota(db, owner.ID, owner.Role, bytes, files)
+}
+
+// SetUserQuota sets per-user overrides; nil keeps the current value,
+// a negative value goes back to the role default, 0 means unlimited.
+func SetUserQuota(userID uint, bytes *int64, files *int64) error {
+	updates := map[string]interface{}{}
+	if bytes != nil {
+		if *bytes < 0 {
+			updates["quota_bytes"] = nil
+		} else {
+			updates["quota_bytes"] = *bytes
+		}
+	}
+	if files != nil {
+		if *files < 0 {
+			updates["quota_files"] = nil
+		} else {
+			updates["quota_files"] = *files
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return DB.Model(&User{}).Where("id = ?", userID).Updates(updates).Error
+}
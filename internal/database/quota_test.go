@@ -0,0 +1,60 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCreatePendingQuota(t *testing.T) {
+	testDB(t)
+	t.Setenv("QUOTA_USER_BYTES", "300")
+
+	alice := seedUser(t, "alice", RoleUser)
+	bob := seedUser(t, "bob", RoleUser)
+
+	t.Run("parallel uploads stay within the quota", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		created, refused := 0, 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				file := &FileMetadata{Name: fmt.Sprintf("f%d.bin", i), S3Key: fmt.Sprintf("uploads/f%d", i), Size: 100, UserID: &alice.ID, Status: "pending"}
+				err := CreatePending(file)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					created++
+				case errors.Is(err, ErrQuotaExceeded):
+					refused++
+				default:
+					t.Errorf("upload %d: %v", i, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if created != 3 || refused != 7 {
+			t.Errorf("created %d, refused %d; want 3 and 7", created, refused)
+		}
+	})
+
+	t.Run("a new version is charged to the file's owner", func(t *testing.T) {
+		// alice is full now, bob has room
+		version := &FileMetadata{Name: "f0.bin", S3Key: "uploads/v", Size: 100, UserID: &bob.ID, Status: "pending"}
+		var current FileMetadata
+		DB.Where("user_id = ?", alice.ID).First(&current)
+		version.ReplacesID = &current.ID
+		if err := CreatePending(version); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("version of alice's file: err = %v, want ErrQuotaExceeded", err)
+		}
+
+		own := &FileMetadata{Name: "b.bin", S3Key: "uploads/b", Size: 100, UserID: &bob.ID, Status: "pending"}
+		if err := CreatePending(own); err != nil {
+			t.Errorf("bob's own upload: %v", err)
+		}
+	})
+}
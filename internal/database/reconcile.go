@@ -0,0 +1,157 @@
+package database
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"s3-drive/internal/storage"
+)
+
+// Objects we create all live under this prefix ("uploads/<uuid>")
+const uploadsPrefix = "uploads/"
+
+// ReconcileReport is the diff between the bucket and FileMetadata
+type ReconcileReport struct {
+	DryRun      bool            `json:"dry_run"`
+	Scanned     int             `json:"scanned"` // Objects listed in the bucket
+	Orphans     []string        `json:"orphans"` // In the bucket, no row points at them
+	OrphanBytes int64           `json:"orphan_bytes"`
+	Deleted     int             `json:"deleted"` // Orphans actually removed (0 on a dry run)
+	Failed      []string        `json:"failed"`  // Orphans we tried and failed to remove
+	Missing     []MissingObject `json:"missing"` // Completed rows whose object is gone
+}
+
+type MissingObject struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	S3Key string `json:"s3_key"`
+}
+
+// Reconcile pages through everything under uploads/ and compares it with the DB.
+// Objects younger than grace are skipped (uploads in flight), and so are rows
+// created within grace. With dryRun=false the orphans are deleted.
+func Reconcile(dryRun bool, grace time.Duration) (*ReconcileReport, error) {
+	cutoff := time.Now().Add(-grace)
+	report := &ReconcileReport{DryRun: dryRun, Orphans: []string{}, Failed: []string{}, Missing: []MissingObject{}}
+
+	// 1. Every key the DB knows about (pending included, their PUT may land any second)
+	var rows []FileMetadata
+	if err := DB.Select("id", "name", "s3_key", "status", "created_at").
+		Where("is_folder = ?", false).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		known[row.S3Key] = true
+	}
+
+	// Old versions of a file live under uploads/ too
+	var versions []string
+	DB.Model(&FileVersion{}).Pluck("s3_key", &versions)
+	for _, k := range versions {
+		known[k] = true
+	}
+
+	// Keys already queued for deletion belong to the deletion worker, not to us
+	var queued []string
+	DB.Model(&PendingDeletion{}).Pluck("s3_key", &queued)
+	for _, k := range queued {
+		known[k] = true
+	}
+
+	// 2. Walk the bucket
+	seen := make(map[string]bool)
+	token := ""
+	for {
+		page, err := storage.Store.ListObjects(uploadsPrefix, token)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Objects {
+			report.Scanned++
+			seen[obj.Key] = true
+			if !known[obj.Key] && obj.LastModified.Before(cutoff) {
+				report.Orphans = append(report.Orphans, obj.Key)
+				report.OrphanBytes += obj.Size
+			}
+		}
+
+		if page.NextToken == "" {
+			break
+		}
+		token = page.NextToken
+	}
+
+	// 3. The reverse: rows that say "completed" but have nothing behind them
+	for _, row := range rows {
+		if row.Status == "completed" && !seen[row.S3Key] && row.CreatedAt < cutoff.Unix() {
+			report.Missing = append(report.Missing, MissingObject{ID: row.ID, Name: row.Name, S3Key: row.S3Key})
+		}
+	}
+
+	if dryRun || len(report.Orphans) == 0 {
+		return report, nil
+	}
+
+	// 4. Delete, but re-check first: a row may have been created since step 1
+	var toDelete []string
+	for start := 0; start < len(report.Orphans); start += 1000 {
+		batch := report.Orphans[start:min(start+1000, len(report.Orphans))]
+
+		var stillKnown []string
+		DB.Model(&FileMetadata{}).Where("s3_key IN ?", batch).Pluck("s3_key", &stillKnown)
+		var stillVersioned []string
+		DB.Model(&FileVersion{}).Where("s3_key IN ?", batch).Pluck("s3_key", &stillVersioned)
+		stillKnown = append(stillKnown, stillVersioned...)
+		claimed := make(map[string]bool, len(stillKnown))
+		for _, k := range stillKnown {
+			claimed[k] = true
+		}
+
+		for _, k := range batch {
+			if !claimed[k] {
+				toDelete = append(toDelete, k)
+			}
+		}
+	}
+
+	// Partial failures are fine, tomorrow's run picks them up again
+	result, err := storage.Store.DeleteMultiple(toDelete)
+	report.Deleted = len(result.Deleted)
+	report.Failed = result.FailedKeys()
+	if err != nil {
+		log.Printf("⚠️ Reconcile: %v\n", err)
+	}
+
+	return report, nil
+}
+
+// StartReconcileTask runs Reconcile once a day.
+// It only reports unless RECONCILE_DELETE=true; RECONCILE_GRACE_HOURS defaults to 24.
+func StartReconcileTask() {
+	dryRun := os.Getenv("RECONCILE_DELETE") != "true"
+
+	grace := 24 * time.Hour
+	if hours, err := strconv.Atoi(os.Getenv("RECONCILE_GRACE_HOURS")); err == nil && hours >= 0 {
+		grace = time.Duration(hours) * time.Hour
+	}
+
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		log.Println("🔍 Reconciling bucket with database...")
+
+		report, err := Reconcile(dryRun, grace)
+		if err != nil {
+			log.Printf("❌ Reconcile Failed: %v\n", err)
+			continue
+		}
+
+		log.Printf("✅ Reconcile Complete. Scanned %d objects: %d orphans (%d bytes, %d deleted), %d rows missing their object.\n",
+			report.Scanned, len(report.Orphans), report.OrphanBytes, report.Deleted, len(report.Missing))
+	}
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// Session is one login on one device. Access tokens (JWTs) are short-lived
+// and name their session; the refresh token that renews them is stored here
+// hashed and rotates on every use. Deleting the row logs that device out.
+type Session struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	CreatedAt   int64  `json:"created_at"`
+	UserID      uint   `gorm:"index" json:"-"` // 0 = guest
+	Role        string `json:"-"`
+	RefreshHash string `gorm:"uniqueIndex" json:"-"`
+	PrevHash    string `gorm:"index" json:"-"` // The refresh token just rotated out, to catch replays
+	ExpiresAt   int64  `gorm:"index" json:"expires_at"`
+	LastUsedAt  int64  `json:"last_used_at"`
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
+
+	Current bool `gorm:"-" json:"current"` // The session asking, in listings
+}
+
+// A session lasts this long since it was last refreshed
+const sessionTTL = 30 * 24 * time.Hour
+
+var ErrSessionInvalid = errors.New("session expired or revoked")
+
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(b)
+	return raw, hashRefreshToken(raw), nil
+}
+
+func hashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a session and returns it with its refresh token
+func CreateSession(userID uint, role string, ip string, userAgent string) (*Session, string, error) {
+	raw, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	now := time.Now()
+	session := Session{
+		CreatedAt: now.Unix(), UserID: userID, Role: role,
+		RefreshHash: hash, ExpiresAt: now.Add(sessionTTL).Unix(), LastUsedAt: now.Unix(),
+		IP: ip, UserAgent: userAgent,
+	}
+	if err := DB.Create(&session).Error; err != nil {
+		return nil, "", err
+	}
+	return &session, raw, nil
+}
+
+// RefreshSession trades a refresh token for a new one (rotation). Presenting
+// one that was already rotated out means it leaked, so the session is killed.
+func RefreshSession(raw string, ip string) (*Session, string, error) {
+	hash := hashRefreshToken(raw)
+
+	var session Session
+	DB.Where("refresh_hash = ?", hash).Limit(1).Find(&session)
+	if session.ID == 0 {
+		var replayed Session
+		DB.Where("prev_hash = ?", hash).Limit(1).Find(&replayed)
+		if replayed.ID != 0 {
+			log.Printf("🚨 Refresh token replayed for session %d (user %d), revoking it\n", replayed.ID, replayed.UserID)
+			DB.Delete(&replayed)
+		}
+		return nil, "", ErrSessionInvalid
+	}
+
+	now := time.Now()
+	if now.Unix() >= session.ExpiresAt {
+		DB.Delete(&session)
+		return nil, "", ErrSessionInvalid
+	}
+
+	newRaw, newHash, err := newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+	// Conditional on the old hash: two refreshes racing can't both win
+	result := DB.Model(&Session{}).Where("id = ? AND refresh_hash = ?", session.ID, hash).Updates(map[string]interface{}{
+		"refresh_hash": newHash, "prev_hash": hash,
+		"expires_at": now.Add(sessionTTL).Unix(), "last_used_at": now.Unix(), "ip": ip,
+	})
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, "", ErrSessionInvalid
+	}
+	return &session, newRaw, nil
+}
+
+// ActiveSession checks an access token's session still exists (not logged out or revoked)
+func ActiveSession(id uint, userID uint) error {
+	var n int64
+	DB.Model(&Session{}).Where("id = ? AND user_id = ? AND expires_at > ?", id, userID, time.Now().Unix()).Count(&n)
+	if n == 0 {
+		return ErrSessionInvalid
+	}
+	return nil
+}
+
+func ListSessions(userID uint, currentID uint) ([]Session, error) {
+	var sessions []Session
+	if err := DB.Where("user_id = ? AND expires_at > ?", userID, time.Now().Unix()).Order("last_used_at desc").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs one of userID's sessions out
+func RevokeSession(id uint, userID uint) error {
+	result := DB.Where("id = ? AND user_id = ?", id, userID).Delete(&Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// RevokeSessions logs userID out everywhere, except keepID (0 = everywhere)
+func RevokeSessions(userID uint, keepID uint) error {
+	return DB.Where("user_id = ? AND id <> ?", userID, keepID).Delete(&Session{}).Error
+}
+
+func purgeExpiredSessions() {
+	DB.Where("expires_at <= ?", time.Now().Unix()).Delete(&Session{})
+}
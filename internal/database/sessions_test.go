@@ -0,0 +1,64 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshSession(t *testing.T) {
+	testDB(t)
+
+	session, first, err := CreateSession(7, RoleUser, "10.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		refreshed, second, err := RefreshSession(first, "10.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refreshed.ID != session.ID || second == first {
+			t.Fatalf("got session %d and the same token back: want session %d with a new token", refreshed.ID, session.ID)
+		}
+		if _, _, err := RefreshSession(second, "10.0.0.2"); err != nil {
+			t.Errorf("refreshing with the new token: %v", err)
+		}
+	})
+
+	t.Run("replay revokes the session", func(t *testing.T) {
+		s, old, _ := CreateSession(7, RoleUser, "", "")
+		_, current, err := RefreshSession(old, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := RefreshSession(old, ""); !errors.Is(err, ErrSessionInvalid) {
+			t.Fatalf("replayed token: err = %v, want ErrSessionInvalid", err)
+		}
+		// The thief's copy and the rightful one both die
+		if _, _, err := RefreshSession(current, ""); !errors.Is(err, ErrSessionInvalid) {
+			t.Errorf("current token after a replay: err = %v, want ErrSessionInvalid", err)
+		}
+		if err := ActiveSession(s.ID, 7); !errors.Is(err, ErrSessionInvalid) {
+			t.Errorf("access tokens of the session still accepted: %v", err)
+		}
+		if err := ActiveSession(session.ID, 7); err != nil {
+			t.Errorf("another session of the same user was revoked: %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s, raw, _ := CreateSession(7, RoleUser, "", "")
+		DB.Model(s).Update("expires_at", time.Now().Add(-time.Second).Unix())
+		if _, _, err := RefreshSession(raw, ""); !errors.Is(err, ErrSessionInvalid) {
+			t.Errorf("expired session: err = %v, want ErrSessionInvalid", err)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		if _, _, err := RefreshSession("nope", ""); !errors.Is(err, ErrSessionInvalid) {
+			t.Errorf("err = %v, want ErrSessionInvalid", err)
+		}
+	})
+}
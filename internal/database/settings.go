@@ -0,0 +1,32 @@
+package database
+
+// Setting is a runtime switch admins can flip without a restart
+type Setting struct {
+	Key   string `gorm:"primaryKey"`
+	Value string
+}
+
+const settingAllowRegistration = "allow_registration"
+
+func getSetting(key string) string {
+	var s Setting
+	DB.Where("key = ?", key).Limit(1).Find(&s)
+	return s.Value
+}
+
+func setSetting(key string, value string) error {
+	return DB.Save(&Setting{Key: key, Value: value}).Error
+}
+
+// RegistrationOpen says whether /api/register accepts new accounts (off by default)
+func RegistrationOpen() bool {
+	return getSetting(settingAllowRegistration) == "true"
+}
+
+func SetRegistrationOpen(open bool) error {
+	value := "false"
+	if open {
+		value = "true"
+	}
+	return setSetting(settingAllowRegistration, value)
+}
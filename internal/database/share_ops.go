@@ -0,0 +1,410 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ShareLink lets anyone holding Token download a file, no account needed.
+// On a folder it opens up the whole subtree (browse + download), never above it.
+type ShareLink struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	Token     string `gorm:"uniqueIndex" json:"token"`
+	FileID    uint   `gorm:"index" json:"file_id"`
+	UserID    *uint  `gorm:"index" json:"user_id,omitempty"` // Who created the link
+
+	PasswordHash string `json:"-"`             // bcrypt, empty = no password
+	ExpiresAt    int64  `json:"expires_at"`    // Unix seconds, 0 = never
+	MaxDownloads int    `json:"max_downloads"` // 0 = unlimited
+	Downloads    int    `gorm:"default:0" json:"downloads"`
+
+	HasPassword bool `gorm:"-" json:"has_password"`
+}
+
+var (
+	ErrShareNotFound  = errors.New("share link not found")
+	ErrShareExpired   = errors.New("share link has expired")
+	ErrShareExhausted = errors.New("share link download limit reached")
+	ErrSharePassword  = errors.New("password required or incorrect")
+)
+
+// newShareToken returns 32 random bytes, URL-safe (43 chars)
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateShareLink makes a public link to a file the caller is allowed to manage.
+// Guests can't: a link outlives the shared guest session it was made from.
+func CreateShareLink(fileID uint, userID uint, role string, password string, expiresAt int64, maxDownloads int) (*ShareLink, error) {
+	if role == "guest" {
+		return nil, errors.New("guests cannot create share links")
+	}
+	if maxDownloads < 0 {
+		return nil, errors.New("max downloads cannot be negative")
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return nil, errors.New("expiry must be in the future")
+	}
+
+	var file FileMetadata
+	if err := DB.First(&file, fileID).Error; err != nil || file.IsTrash || file.Status != "completed" {
+		return nil, errors.New("file not found")
+	}
+	if !canWrite(file, userID, role) {
+		return nil, errors.New("permission denied")
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link := ShareLink{Token: token, FileID: file.ID, ExpiresAt: expiresAt, MaxDownloads: maxDownloads}
+	if userID != 0 {
+		link.UserID = &userID
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+		if err != nil {
+			return nil, err
+		}
+		link.PasswordHash = string(hash)
+		link.HasPassword = true
+	}
+
+	if err := DB.Create(&link).Error; err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ListShareLinks returns the caller's links plus every link on items they own
+// (admin: everyone's), optionally only those of one file.
+func ListShareLinks(fileID uint, userID uint, role string) ([]ShareLink, error) {
+	query := DB.Model(&ShareLink{})
+	if fileID != 0 {
+		query = query.Where("file_id = ?", fileID)
+	}
+	if role != "admin" && !ownsLinkedItem(fileID, userID, role) {
+		query = query.Where(DB.Where("user_id = ?", userID).
+			Or("file_id IN (?)", DB.Model(&FileMetadata{}).Select("id").Where("user_id = ?", userID)))
+	}
+
+	var links []ShareLink
+	if err := query.Order("created_at desc").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	for i := range links {
+		links[i].HasPassword = links[i].PasswordHash != ""
+	}
+	return links, nil
+}
+
+// ownsLinkedItem: owners of an item (directly, through a folder above it or by
+// grant) manage all its links, including those editors made
+func ownsLinkedItem(fileID uint, userID uint, role string) bool {
+	var item FileMetadata
+	if fileID == 0 || DB.First(&item, fileID).Error != nil {
+		return false
+	}
+	return accessLevel(item, userID, role) >= levelOwner
+}
+
+// RevokeShareLink deletes a link; it stops working immediately.
+// The link's creator and the owners of its item may do this.
+func RevokeShareLink(id uint, userID uint, role string) error {
+	var link ShareLink
+	if err := DB.First(&link, id).Error; err != nil {
+		return ErrShareNotFound
+	}
+	isCreator := link.UserID != nil && *link.UserID == userID
+	if role != "admin" && !isCreator && !ownsLinkedItem(link.FileID, userID, role) {
+		return ErrShareNotFound
+	}
+
+	result := DB.Delete(&link)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// SharedItem is what an anonymous visitor gets to see of a shared folder
+type SharedItem struct {
+	ID        uint   `json:"id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mime_type"`
+	IsFolder  bool   `json:"is_folder"`
+	ParentID  *uint  `json:"parent_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// SharedZipEntry is one file of a shared folder's zip, Path relative to the zipped folder
+type SharedZipEntry struct {
+	Path      string
+	S3Key     string
+	CreatedAt int64
+}
+
+func findShareLink(token string) (*ShareLink, error) {
+	var link ShareLink
+	if token != "" {
+		DB.Where("token = ?", token).Limit(1).Find(&link)
+	}
+	if link.ID == 0 {
+		return nil, ErrShareNotFound
+	}
+	if link.ExpiresAt != 0 && time.Now().Unix() >= link.ExpiresAt {
+		return nil, ErrShareExpired
+	}
+	return &link, nil
+}
+
+// UnlockShareLink checks a link's password. It's the only bcrypt a visitor
+// costs: the handler trades it for a short-lived access token for the link.
+func UnlockShareLink(token string, password string) (*ShareLink, error) {
+	link, err := findShareLink(token)
+	if err != nil {
+		return nil, err
+	}
+	if link.PasswordHash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+			return nil, ErrSharePassword
+		}
+	}
+	return link, nil
+}
+
+// OpenShareLink checks a token and returns the shared item. unlockedID is the
+// link a verified access token opens (needed when the link has a password).
+// Nothing is counted: browsing a shared folder is free, downloads are not.
+func OpenShareLink(token string, unlockedID uint) (*ShareLink, *FileMetadata, error) {
+	link, err := findShareLink(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if link.PasswordHash != "" && unlockedID != link.ID {
+		return nil, nil, ErrSharePassword
+	}
+
+	// Trashed or unfinished items are not served, the link just looks dead
+	var root FileMetadata
+	if err := DB.First(&root, link.FileID).Error; err != nil || root.IsTrash || root.Status != "completed" {
+		return nil, nil, ErrShareNotFound
+	}
+	// Same once its creator couldn't make it anymore (grant revoked, item
+	// moved out of reach, account disabled or demoted)
+	if !creatorCanShare(link, root) {
+		return nil, nil, ErrShareNotFound
+	}
+	return link, &root, nil
+}
+
+// creatorCanShare re-checks CreateShareLink's rule with the creator's current access
+func creatorCanShare(link *ShareLink, root FileMetadata) bool {
+	if link.UserID == nil {
+		return false
+	}
+	creator, err := ActiveUser(*link.UserID)
+	if err != nil {
+		return false
+	}
+	return canWrite(root, creator.ID, creator.Role)
+}
+
+// ResolveShareLink checks a token (and unlock) and counts one download.
+// fileID is only used by folder links: the file to fetch, anywhere below the
+// shared folder. With fileID 0 a folder link returns the folder itself, uncounted.
+func ResolveShareLink(token string, unlockedID uint, fileID uint) (*FileMetadata, error) {
+	link, root, err := OpenShareLink(token, unlockedID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Folder link without a file: just opening it, nothing to count
+	if root.IsFolder && fileID == 0 {
+		return root, nil
+	}
+
+	file := root
+	if root.IsFolder {
+		file, err = sharedItem(root, fileID)
+		if err != nil {
+			return nil, err
+		}
+		if file.IsFolder {
+			return nil, errors.New("not a file")
+		}
+	}
+
+	if err := countShareDownload(link); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ListSharedFolder lists a folder of a shared subtree (folderID nil = the shared folder itself).
+// parentID is nil at the shared folder: what sits above it is none of the visitor's business.
+func ListSharedFolder(token string, unlockedID uint, folderID *uint) (folder *FileMetadata, parentID *uint, items []SharedItem, err error) {
+	_, root, err := OpenShareLink(token, unlockedID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !root.IsFolder {
+		return nil, nil, nil, errors.New("not a folder link")
+	}
+
+	folder = root
+	if folderID != nil {
+		if folder, err = sharedItem(root, *folderID); err != nil {
+			return nil, nil, nil, err
+		}
+		if !folder.IsFolder {
+			return nil, nil, nil, errors.New("not a folder")
+		}
+	}
+	if folder.ID != root.ID {
+		parentID = folder.ParentID
+	}
+
+	items, err = SharedFolderItems(folder)
+	return folder, parentID, items, err
+}
+
+// SharedFolderItems lists a folder with no permission filter at all: only call it
+// on a folder that OpenShareLink / sharedItem already proved is shared.
+func SharedFolderItems(folder *FileMetadata) ([]SharedItem, error) {
+	var files []FileMetadata
+	if err := folderQuery(&folder.ID).Order("is_folder desc, name asc").Find(&files).Error; err != nil {
+		return nil, err
+	}
+
+	items := make([]SharedItem, 0, len(files))
+	for _, f := range files {
+		items = append(items, SharedItem{
+			ID: f.ID, Name: f.Name, Size: f.Size, MimeType: f.MimeType,
+			IsFolder: f.IsFolder, ParentID: f.ParentID, CreatedAt: f.CreatedAt,
+		})
+	}
+	return items, nil
+}
+
+// SharedZip collects every file below a folder of a shared subtree (folderID nil =
+// the shared folder) and counts one download for the whole zip.
+func SharedZip(token string, unlockedID uint, folderID *uint) (*FileMetadata, []SharedZipEntry, error) {
+	link, root, err := OpenShareLink(token, unlockedID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !root.IsFolder {
+		return nil, nil, errors.New("not a folder link")
+	}
+
+	folder := root
+	if folderID != nil {
+		if folder, err = sharedItem(root, *folderID); err != nil {
+			return nil, nil, err
+		}
+		if !folder.IsFolder {
+			return nil, nil, errors.New("not a folder")
+		}
+	}
+
+	// BFS visits parents before children, so their path is always known
+	paths := map[uint]string{folder.ID: ""}
+	var entries []SharedZipEntry
+	walkSubtree(*folder, func(item FileMetadata) error {
+		if item.ID == folder.ID {
+			return nil
+		}
+		prefix, ok := paths[*item.ParentID]
+		if !ok || item.IsTrash || item.Status != "completed" {
+			return nil
+		}
+		if item.IsFolder {
+			paths[item.ID] = prefix + zipSafeName(item.Name) + "/"
+		} else {
+			entries = append(entries, SharedZipEntry{Path: prefix + zipSafeName(item.Name), S3Key: item.S3Key, CreatedAt: item.CreatedAt})
+		}
+		return nil
+	})
+
+	if err := countShareDownload(link); err != nil {
+		return nil, nil, err
+	}
+	return folder, entries, nil
+}
+
+// zipSafeName makes one path component safe to extract: names saved before
+// CleanName existed may hold slashes or be "..", which would escape the zip
+func zipSafeName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(strings.TrimSpace(name))
+	name = strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f {
+			return -1
+		}
+		return c
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// sharedItem loads id and makes sure it sits inside root's subtree.
+// Walking up the parents is what keeps visitors from leaving the shared folder.
+func sharedItem(root *FileMetadata, id uint) (*FileMetadata, error) {
+	var item FileMetadata
+	if err := DB.First(&item, id).Error; err != nil {
+		return nil, ErrShareNotFound
+	}
+	if item.IsTrash || item.Status != "completed" {
+		return nil, ErrShareNotFound
+	}
+
+	cur := item
+	for steps := 0; steps <= maxFolderDepth+1; steps++ {
+		if cur.ID == root.ID {
+			return &item, nil
+		}
+		if cur.ParentID == nil {
+			break
+		}
+		var parent FileMetadata
+		if err := DB.First(&parent, *cur.ParentID).Error; err != nil || parent.IsTrash {
+			break
+		}
+		cur = parent
+	}
+	return nil, ErrShareNotFound
+}
+
+// countShareDownload bumps the counter in a single conditional UPDATE,
+// so concurrent requests can't go over MaxDownloads.
+func countShareDownload(link *ShareLink) error {
+	result := DB.Model(&ShareLink{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", link.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrShareExhausted
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// seedUser adds an account without going through bcrypt
+func seedUser(t *testing.T, username string, role string) User {
+	t.Helper()
+	user := User{Username: username, Role: role}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestShareLinks(t *testing.T) {
+	testDB(t)
+
+	alice := seedUser(t, "alice", RoleUser)
+	editor := seedUser(t, "eddie", RoleUser)
+	other := seedUser(t, "mallory", RoleUser)
+
+	shared := seedItem(t, FileMetadata{Name: "shared", IsFolder: true, UserID: &alice.ID})
+	inside := seedItem(t, FileMetadata{Name: "inside.txt", S3Key: "uploads/i", UserID: &alice.ID, ParentID: &shared.ID, Depth: 1})
+	outside := seedItem(t, FileMetadata{Name: "outside.txt", S3Key: "uploads/o", UserID: &alice.ID})
+	private := seedItem(t, FileMetadata{Name: "private", IsFolder: true, UserID: &alice.ID})
+	elsewhere := seedItem(t, FileMetadata{Name: "secret.txt", S3Key: "uploads/s", UserID: &alice.ID, ParentID: &private.ID, Depth: 1})
+	file := seedItem(t, FileMetadata{Name: "report.pdf", S3Key: "uploads/r", UserID: &alice.ID})
+	grant := ACLEntry{ItemID: shared.ID, SubjectType: subjectUser, SubjectID: editor.ID, Level: "editor"}
+	DB.Create(&grant)
+
+	folderLink, err := CreateShareLink(shared.ID, alice.ID, RoleUser, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("subtree", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			fileID  uint
+			wantErr bool
+		}{
+			{"file inside the shared folder", inside.ID, false},
+			{"file next to the shared folder", outside.ID, true},
+			{"file in another folder", elsewhere.ID, true},
+			{"missing file", 9999, true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := ResolveShareLink(folderLink.Token, 0, tt.fileID)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+				}
+			})
+		}
+		if _, _, _, err := ListSharedFolder(folderLink.Token, 0, &private.ID); err == nil {
+			t.Error("listed a folder outside the share")
+		}
+	})
+
+	t.Run("shared root hides its parent", func(t *testing.T) {
+		nested := seedItem(t, FileMetadata{Name: "nested", IsFolder: true, UserID: &alice.ID, ParentID: &private.ID, Depth: 1})
+		sub := seedItem(t, FileMetadata{Name: "sub", IsFolder: true, UserID: &alice.ID, ParentID: &nested.ID, Depth: 2})
+		link, err := CreateShareLink(nested.ID, alice.ID, RoleUser, "", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, folderID := range []*uint{nil, &nested.ID} {
+			folder, parentID, _, err := ListSharedFolder(link.Token, 0, folderID)
+			if err != nil || folder.ID != nested.ID || parentID != nil {
+				t.Errorf("root listing: parent %v, %v; want no parent", parentID, err)
+			}
+		}
+		_, parentID, _, err := ListSharedFolder(link.Token, 0, &sub.ID)
+		if err != nil || parentID == nil || *parentID != nested.ID {
+			t.Errorf("subfolder listing: parent %v, %v; want the shared folder", parentID, err)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		link, _ := CreateShareLink(file.ID, alice.ID, RoleUser, "", time.Now().Add(time.Hour).Unix(), 0)
+		if _, err := ResolveShareLink(link.Token, 0, 0); err != nil {
+			t.Fatalf("fresh link: %v", err)
+		}
+		DB.Model(link).Update("expires_at", time.Now().Add(-time.Second).Unix())
+		if _, err := ResolveShareLink(link.Token, 0, 0); !errors.Is(err, ErrShareExpired) {
+			t.Errorf("expired link: err = %v, want ErrShareExpired", err)
+		}
+		if _, err := CreateShareLink(file.ID, alice.ID, RoleUser, "", time.Now().Add(-time.Hour).Unix(), 0); err == nil {
+			t.Error("created a link that expired already")
+		}
+	})
+
+	t.Run("download cap", func(t *testing.T) {
+		link, _ := CreateShareLink(file.ID, alice.ID, RoleUser, "", 0, 2)
+		for i := 0; i < 2; i++ {
+			if _, err := ResolveShareLink(link.Token, 0, 0); err != nil {
+				t.Fatalf("download %d: %v", i+1, err)
+			}
+		}
+		if _, err := ResolveShareLink(link.Token, 0, 0); !errors.Is(err, ErrShareExhausted) {
+			t.Errorf("third download: err = %v, want ErrShareExhausted", err)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		link, _ := CreateShareLink(file.ID, alice.ID, RoleUser, "hunter22", 0, 0)
+		if _, err := ResolveShareLink(link.Token, 0, 0); !errors.Is(err, ErrSharePassword) {
+			t.Errorf("locked link: err = %v, want ErrSharePassword", err)
+		}
+		if _, err := UnlockShareLink(link.Token, "wrong"); !errors.Is(err, ErrSharePassword) {
+			t.Errorf("wrong password: err = %v, want ErrSharePassword", err)
+		}
+		unlocked, err := UnlockShareLink(link.Token, "hunter22")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ResolveShareLink(link.Token, unlocked.ID, 0); err != nil {
+			t.Errorf("unlocked link: %v", err)
+		}
+		if _, err := ResolveShareLink(link.Token, folderLink.ID, 0); !errors.Is(err, ErrSharePassword) {
+			t.Errorf("another link's unlock: err = %v, want ErrSharePassword", err)
+		}
+	})
+
+	t.Run("owner manages links editors made", func(t *testing.T) {
+		link, err := CreateShareLink(inside.ID, editor.ID, RoleUser, "", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links, _ := ListShareLinks(inside.ID, alice.ID, RoleUser)
+		if len(links) != 1 || links[0].ID != link.ID {
+			t.Fatalf("owner sees %d links on the item, want the editor's", len(links))
+		}
+		if links, _ := ListShareLinks(inside.ID, other.ID, RoleUser); len(links) != 0 {
+			t.Errorf("unrelated user sees %d links", len(links))
+		}
+		if err := RevokeShareLink(link.ID, other.ID, RoleUser); !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("unrelated user revoked: err = %v", err)
+		}
+		if err := RevokeShareLink(link.ID, alice.ID, RoleUser); err != nil {
+			t.Errorf("owner revoke: %v", err)
+		}
+	})
+
+	t.Run("link dies with its creator's access", func(t *testing.T) {
+		link, err := CreateShareLink(inside.ID, editor.ID, RoleUser, "", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ResolveShareLink(link.Token, 0, 0); err != nil {
+			t.Fatalf("while granted: %v", err)
+		}
+		if err := RevokeGrant(grant.ID, alice.ID, RoleUser); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ResolveShareLink(link.Token, 0, 0); !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("after the grant is revoked: err = %v, want ErrShareNotFound", err)
+		}
+
+		DB.Model(&alice).Update("disabled", true)
+		if _, _, err := OpenShareLink(folderLink.Token, 0); !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("creator disabled: err = %v, want ErrShareNotFound", err)
+		}
+	})
+}
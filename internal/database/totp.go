@@ -0,0 +1,222 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RecoveryCode is a one-time fallback for a lost authenticator (stored hashed)
+type RecoveryCode struct {
+	ID       uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"index"`
+	UsedAt   int64
+}
+
+// RFC 6238 defaults, what every authenticator app expects
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpIssuer        = "S3-Drive"
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPInvalid       = errors.New("invalid two-factor code")
+	ErrTOTPNotEnrolled   = errors.New("two-factor authentication is not set up")
+	ErrTOTPAlreadyActive = errors.New("two-factor authentication is already on")
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the code for one 30s step (HMAC-SHA1, dynamic truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// matchTOTP returns the step code matches (allowing one step of clock drift), or 0
+func matchTOTP(secret string, code string) int64 {
+	key, err := b32.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	now := time.Now().Unix() / totpPeriod
+	for _, step := range []int64{now, now - 1, now + 1} {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+// EnrollTOTP creates a fresh secret (not active until ActivateTOTP) and
+// returns it with the otpauth:// URI for authenticator apps
+func EnrollTOTP(userID uint) (string, string, error) {
+	var user User
+	if err := DB.First(&user, userID).Error; err != nil {
+		return "", "", errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return "", "", ErrTOTPAlreadyActive
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret := b32.EncodeToString(raw)
+	if err := DB.Model(&user).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+		return "", "", err
+	}
+
+	label := url.PathEscape(totpIssuer + ":" + user.Username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return secret, "otpauth://totp/" + label + "?" + q.Encode(), nil
+}
+
+// ActivateTOTP turns 2FA on once the user proves their app has the secret,
+// and returns the recovery codes (shown only now)
+func ActivateTOTP(userID uint, code string) ([]string, error) {
+	var user User
+	if err := DB.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyActive
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	step := matchTOTP(user.TOTPSecret, strings.TrimSpace(code))
+	if step == 0 {
+		return nil, ErrTOTPInvalid
+	}
+
+	if err := DB.Model(&user).Updates(map[string]interface{}{"totp_enabled": true, "totp_last_step": step}).Error; err != nil {
+		return nil, err
+	}
+	return NewRecoveryCodes(user.ID)
+}
+
+// CheckSecondFactor accepts a current TOTP code or an unused recovery code.
+// A TOTP code works once (replaying it within its 30s window fails). Wrong
+// codes count towards the account's lockout, so a challenge can't be guessed at.
+func CheckSecondFactor(userID uint, code string) error {
+	var user User
+	if err := DB.First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnrolled
+	}
+	if loginLocked(&user, "") {
+		return ErrLoginLocked
+	}
+
+	err := useSecondFactor(&user, code)
+	if errors.Is(err, ErrTOTPInvalid) {
+		recordFailedCode(user.ID)
+	} else if err == nil {
+		loginComplete(user.ID)
+	}
+	return err
+}
+
+// useSecondFactor redeems code for user (TOTP step or recovery code)
+func useSecondFactor(user *User, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+
+	if step := matchTOTP(user.TOTPSecret, code); step != 0 {
+		// Conditional update: the same code can't win twice, even concurrently
+		result := DB.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil
+		}
+		return ErrTOTPInvalid
+	}
+
+	result := DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at = ?", user.ID, hashRecoveryCode(code), 0).
+		Update("used_at", time.Now().Unix())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTOTPInvalid
+	}
+	return nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRecoveryCodes replaces a user's recovery codes ("XXXXX-XXXXX", 50 bits each)
+func NewRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		c := b32.EncodeToString(raw)[:10]
+		codes = append(codes, c[:5]+"-"+c[5:])
+		rows = append(rows, RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(c)})
+	}
+
+	if err := DB.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	if err := DB.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes counts the unused ones
+func RemainingRecoveryCodes(userID uint) int64 {
+	var n int64
+	DB.Model(&RecoveryCode{}).Where("user_id = ? AND used_at = ?", userID, 0).Count(&n)
+	return n
+}
+
+// DisableTOTP turns 2FA off and forgets the secret and recovery codes
+func DisableTOTP(userID uint) error {
+	result := DB.Model(&User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return DB.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1 seed. The RFC lists 8 digits; we keep the last 6.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.time/totpPeriod); got != tt.want {
+			t.Errorf("T=%d: totpCode = %s, want %s", tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestSecondFactorSingleUse(t *testing.T) {
+	testDB(t)
+
+	user := User{Username: "alice", Role: RoleUser}
+	DB.Create(&user)
+	secret, _, err := EnrollTOTP(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := b32.DecodeString(secret)
+	now := time.Now().Unix() / totpPeriod
+
+	recovery, err := ActivateTOTP(user.ID, totpCode(key, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("TOTP code", func(t *testing.T) {
+		// Activation used up the current step already
+		if err := CheckSecondFactor(user.ID, totpCode(key, now)); !errors.Is(err, ErrTOTPInvalid) {
+			t.Errorf("code used for activation: err = %v, want ErrTOTPInvalid", err)
+		}
+		if err := CheckSecondFactor(user.ID, totpCode(key, now+1)); err != nil {
+			t.Fatalf("next step's code: %v", err)
+		}
+		if err := CheckSecondFactor(user.ID, totpCode(key, now+1)); !errors.Is(err, ErrTOTPInvalid) {
+			t.Errorf("same code again: err = %v, want ErrTOTPInvalid", err)
+		}
+		// Still inside the drift window, but older than the last one used
+		if err := CheckSecondFactor(user.ID, totpCode(key, now-1)); !errors.Is(err, ErrTOTPInvalid) {
+			t.Errorf("earlier step's code: err = %v, want ErrTOTPInvalid", err)
+		}
+	})
+
+	t.Run("recovery code", func(t *testing.T) {
+		if len(recovery) != recoveryCodeCount {
+			t.Fatalf("%d recovery codes, want %d", len(recovery), recoveryCodeCount)
+		}
+		if err := CheckSecondFactor(user.ID, recovery[0]); err != nil {
+			t.Fatalf("first use: %v", err)
+		}
+		if err := CheckSecondFactor(user.ID, recovery[0]); !errors.Is(err, ErrTOTPInvalid) {
+			t.Errorf("second use: err = %v, want ErrTOTPInvalid", err)
+		}
+		if n := RemainingRecoveryCodes(user.ID); n != recoveryCodeCount-1 {
+			t.Errorf("%d codes left, want %d", n, recoveryCodeCount-1)
+		}
+	})
+}
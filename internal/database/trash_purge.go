@@ -0,0 +1,91 @@
+package database
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Default for TRASH_RETENTION_DAYS
+const defaultTrashRetentionDays = 30
+
+// trashEntries are the top-level items in Trash (a trashed folder's contents go with it)
+func trashEntries() *gorm.DB {
+	return DB.Model(&FileMetadata{}).Where("is_trash = ?", true).
+		Where("trash_root_id IS NULL OR trash_root_id = id")
+}
+
+// EmptyTrash permanently deletes everything in the user's Trash. Returns rows removed.
+func EmptyTrash(userID uint, role string) (int, error) {
+	if userID == 0 {
+		return 0, nil // Guests have no Trash (see GetTrash)
+	}
+
+	var entries []FileMetadata
+	if err := trashEntries().Where("user_id = ?", userID).Find(&entries).Error; err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		result, err := HardDelete(e.ID, userID, role)
+		if err != nil {
+			continue // Already gone with an earlier entry's folder
+		}
+		removed += len(result.DBIds)
+	}
+	return removed, nil
+}
+
+// PurgeTrash permanently deletes Trash entries older than retention. Returns rows removed.
+func PurgeTrash(retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention).Unix()
+
+	// Rows trashed before trashed_at existed fall back to updated_at
+	var expired []FileMetadata
+	if err := trashEntries().Where("COALESCE(NULLIF(trashed_at, 0), updated_at) < ?", cutoff).
+		Find(&expired).Error; err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range expired {
+		var owner uint
+		if e.UserID != nil {
+			owner = *e.UserID
+		}
+
+		// Same path as handleDelete; the owner could do it, so the system can too
+		result, err := HardDelete(e.ID, owner, "admin")
+		if err != nil {
+			continue
+		}
+		removed += len(result.DBIds)
+	}
+	return removed, nil
+}
+
+// StartTrashPurgeTask empties expired Trash forever in the background.
+// Retention comes from TRASH_RETENTION_DAYS (default 30).
+func StartTrashPurgeTask() {
+	days := defaultTrashRetentionDays
+	if d, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil && d > 0 {
+		days = d
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := PurgeTrash(retention)
+		if err != nil {
+			log.Printf("❌ Trash Purge Failed: %v\n", err)
+		} else if removed > 0 {
+			log.Printf("🗑️ Trash Purge: removed %d items older than %d days.\n", removed, days)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"s3-drive/internal/storage"
+)
+
+// Serializes CreatePending here; the row locks below do the same across instances (Postgres)
+var pendingMu sync.Mutex
+
+// CreatePending saves a new pending upload row. What the row takes up (a drop
+// link's file slot, the owner's quota) is checked in the same transaction, so
+// parallel uploads can't all pass the check and go over the limit together.
+func CreatePending(file *FileMetadata) error {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if file.FileRequestID != nil {
+			var req FileRequest
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&req, *file.FileRequestID).Error; err != nil {
+				return ErrRequestNotFound
+			}
+			if req.MaxFiles > 0 && countDrops(tx, req.ID) >= int64(req.MaxFiles) {
+				return ErrRequestFull
+			}
+		}
+
+		// A new version ends up on the file it replaces, so its owner pays for it
+		owner := file.UserID
+		if file.ReplacesID != nil {
+			var current FileMetadata
+			if err := tx.First(&current, *file.ReplacesID).Error; err == nil {
+				owner = current.UserID
+			}
+		}
+		if err := checkOwnerQuota(tx, owner, file.Size, 1); err != nil {
+			return err
+		}
+
+		return tx.Create(file).Error
+	})
+}
+
+// GetPendingUpload loads an in-flight upload the caller is allowed to finish.
+// Admin can finish anything, users only their own, guests only guest
+// uploads (no guest sessions, so any guest's).
+func GetPendingUpload(fileID uint, userID uint, role string) (*FileMetadata, error) {
+	query := DB.Where("id = ? AND status = ?", fileID, "pending")
+
+	switch {
+	case role == RoleAdmin:
+	case role == "guest" || userID == 0:
+		query = query.Where("user_id IS NULL")
+	default:
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var file FileMetadata
+	if err := query.First(&file).Error; err != nil {
+		return nil, errors.New("upload not found or access denied")
+	}
+	return &file, nil
+}
+
+// ErrUploadMissing means the client finalized before the object reached the store
+var ErrUploadMissing = errors.New("upload not found in storage")
+
+// CompleteUpload checks the object actually landed with the promised size,
+// then flips the row to 'completed' with the store's ETag and Content-Type.
+// A size mismatch marks the row 'failed' and removes the object.
+func CompleteUpload(file *FileMetadata) error {
+	info, err := storage.Store.HeadObject(file.S3Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrUploadMissing
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Size != file.Size {
+		DB.Model(file).Update("status", "failed")
+		storage.Store.DeleteFile(file.S3Key) // Best effort, the cleanup task removes the row
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", file.Size, info.Size)
+	}
+
+	mimeType := info.ContentType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	// Re-upload of an existing file: becomes its new version
+	if file.ReplacesID != nil {
+		return promoteVersion(file, info.ETag, mimeType)
+	}
+
+	return DB.Model(file).Updates(map[string]interface{}{
+		"status":    "completed",
+		"upload_id": "",
+		"etag":      info.ETag,
+		"mime_type": mimeType,
+	}).Error
+}
+
+// How long a multipart upload can sit idle before cleanup aborts it
+const multipartResumeWindow = 7 * 24 * time.Hour
+
+// ListPendingUploads returns the caller's unfinished multipart uploads,
+// so a browser that was closed mid-upload can find them again.
+func ListPendingUploads(userID uint, role string) ([]FileMetadata, error) {
+	var files []FileMetadata
+	query := DB.Where("status = ? AND COALESCE(upload_id, '') <> ''", "pending")
+
+	if role == "guest" || userID == 0 {
+		// No guest sessions, so we can't tell one guest's uploads from another's
+		return []FileMetadata{}, nil
+	}
+	query = query.Where("user_id = ?", userID)
+
+	err := query.Order("updated_at desc").Find(&files).Error
+	return files, err
+}
+
+// TouchUpload marks an upload as still alive so cleanup leaves it alone
+func TouchUpload(file *FileMetadata) error {
+	return DB.Model(file).Update("updated_at", time.Now().Unix()).Error
+}
+
+// abortStaleMultipartUploads frees the parts of uploads nobody came back for
+// and removes their rows.
+func abortStaleMultipartUploads(before int64) {
+	var stale []FileMetadata
+	DB.Where("status = ? AND COALESCE(upload_id, '') <> '' AND updated_at < ?", "pending", before).Find(&stale)
+
+	for _, f := range stale {
+		if err := storage.Store.AbortMultipartUpload(f.S3Key, f.UploadID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("❌ Could not abort upload %d: %v\n", f.ID, err)
+			continue // try again tomorrow
+		}
+		BatchDelete([]uint{f.ID}, nil) // Aborting already freed the parts
+	}
+
+	if len(stale) > 0 {
+		log.Printf("✅ Aborted %d stale multipart uploads.\n", len(stale))
+	}
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a User can have. "guest" is not one: guests have no account (ID 0).
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const minPasswordLength = 8
+
+var ErrUserDisabled = errors.New("account disabled")
+
+// HashPassword is the one place account passwords get hashed
+func HashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	return string(hash), err
+}
+
+func validUsername(username string) bool {
+	return username != "" && len(username) <= 64 && !strings.ContainsAny(username, " /\\@:")
+}
+
+// cleanEmail lowercases an address and makes sure no other account has it
+// ("" = no email). SSO logins link to accounts by this address, so only
+// admins set it: a self-registered address would let anyone claim it first.
+func cleanEmail(email string, exceptID uint) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", nil
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email || len(email) > 254 {
+		return "", errors.New("invalid email")
+	}
+
+	var taken int64
+	DB.Model(&User{}).Where("LOWER(email) = ? AND id <> ?", email, exceptID).Count(&taken)
+	if taken > 0 {
+		return "", errors.New("email already used by another account")
+	}
+	return email, nil
+}
+
+// CreateUser adds an account with the given role (email optional)
+func CreateUser(username string, password string, role string, email string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if !validUsername(username) {
+		return nil, errors.New("invalid username")
+	}
+	if role != RoleAdmin && role != RoleUser {
+		return nil, errors.New("role must be admin or user")
+	}
+	email, err := cleanEmail(email, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	var taken int64
+	DB.Model(&User{}).Where("username = ?", username).Count(&taken)
+	if taken > 0 {
+		return nil, errors.New("username already taken")
+	}
+
+	user := User{Username: username, Password: hash, Role: role, Email: email, CreatedAt: time.Now().Unix()}
+	if err := DB.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Authenticate checks a username/password pair; ip is the client's (wrong
+// passwords are counted per account and IP, see lockout.go)
+func Authenticate(username string, password string, ip string) (*User, error) {
+	var user User
+	if err := DB.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, errors.New("invalid credentials")
+	}
+	if loginLocked(&user, ip) {
+		return nil, ErrLoginLocked
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		recordFailedPassword(user.ID, ip)
+		return nil, errors.New("invalid credentials")
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	passwordOK(user.ID, ip)
+	if !user.TOTPEnabled { // With 2FA the login isn't done yet: CheckSecondFactor resets
+		loginComplete(user.ID)
+	}
+	return &user, nil
+}
+
+// ActiveUser loads a user that is still allowed in (exists, not disabled).
+// authMiddleware calls it on every request so disabling or deleting an account,
+// or changing its role, takes effect without waiting for tokens to expire.
+func ActiveUser(id uint) (*User, error) {
+	var user User
+	if err := DB.First(&user, id).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return &user, nil
+}
+
+func ListUsers() ([]User, error) {
+	var users []User
+	err := DB.Order("username asc").Find(&users).Error
+	return users, err
+}
+
+// otherActiveAdmins counts enabled admins besides id
+func otherActiveAdmins(id uint) int64 {
+	var n int64
+	DB.Model(&User{}).Where("role = ? AND disabled = ? AND id <> ?", RoleAdmin, false, id).Count(&n)
+	return n
+}
+
+// UpdateUser changes a user's role and/or disabled flag (nil = leave as is).
+// The last enabled admin can't be demoted or disabled.
+func UpdateUser(id uint, role *string, disabled *bool, email *string) (*User, error) {
+	var user User
+	if err := DB.First(&user, id).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	updates := map[string]interface{}{}
+	if role != nil {
+		if *role != RoleAdmin && *role != RoleUser {
+			return nil, errors.New("role must be admin or user")
+		}
+		updates["role"] = *role
+	}
+	if disabled != nil {
+		updates["disabled"] = *disabled
+	}
+	if email != nil {
+		clean, err := cleanEmail(*email, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		updates["email"] = clean
+	}
+
+	losesAdmin := user.Role == RoleAdmin && !user.Disabled &&
+		((role != nil && *role != RoleAdmin) || (disabled != nil && *disabled))
+	if losesAdmin && otherActiveAdmins(user.ID) == 0 {
+		return nil, errors.New("cannot remove the last admin")
+	}
+
+	if len(updates) > 0 {
+		if err := DB.Model(&user).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	if disabled != nil && *disabled {
+		RevokeSessions(user.ID, 0)
+	}
+	return &user, nil
+}
+
+// SetPassword replaces a user's password (admin reset or self-service change)
+// and logs the account out everywhere except keepSessionID (0 = everywhere)
+func SetPassword(id uint, password string, keepSessionID uint) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	result := DB.Model(&User{}).Where("id = ?", id).Update("password", hash)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return RevokeSessions(id, keepSessionID)
+}
+
+// DeleteUser removes an account and everything it owns (files go through
+// HardDelete, so their objects are queued like any other delete).
+func DeleteUser(id uint) error {
+	var user User
+	if err := DB.First(&user, id).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if user.Role == RoleAdmin && !user.Disabled && otherActiveAdmins(user.ID) == 0 {
+		return errors.New("cannot delete the last admin")
+	}
+
+	// Shallowest first: deleting a folder takes its subtree along,
+	// so later IDs may already be gone
+	var owned []FileMetadata
+	if err := DB.Where("user_id = ?", id).Order("depth asc").Find(&owned).Error; err != nil {
+		return err
+	}
+	for _, item := range owned {
+		var exists int64
+		DB.Model(&FileMetadata{}).Where("id = ?", item.ID).Count(&exists)
+		if exists == 0 {
+			continue
+		}
+		if _, err := HardDelete(item.ID, id, RoleAdmin); err != nil {
+			return err
+		}
+	}
+
+	DB.Where("user_id = ?", id).Delete(&ShareLink{})
+	DB.Where("user_id = ?", id).Delete(&FileRequest{})
+	DB.Where("subject_type = ? AND subject_id = ?", subjectUser, id).Delete(&ACLEntry{})
+	DB.Where("user_id = ?", id).Delete(&GroupMember{})
+	DB.Where("user_id = ?", id).Delete(&APIToken{})
+	DB.Where("user_id = ?", id).Delete(&Session{})
+	DB.Where("user_id = ?", id).Delete(&RecoveryCode{})
+	return DB.Delete(&user).Error
+}
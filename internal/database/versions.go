@@ -0,0 +1,290 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FileVersion is an older copy of a file. The current version lives on
+// FileMetadata itself; this table only holds what it replaced.
+type FileVersion struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	FileID    uint   `gorm:"index" json:"file_id"`
+	Version   int    `json:"version"`
+	S3Key     string `json:"-"`
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mime_type"`
+	ETag      string `gorm:"column:etag" json:"etag,omitempty"`
+	UserID    *uint  `json:"user_id,omitempty"` // Who uploaded this version
+	CreatedAt int64  `json:"created_at"`        // When it was uploaded (not when it was replaced)
+}
+
+// VersionInfo is one line of a file's history, current version included
+type VersionInfo struct {
+	ID         uint   `json:"id"` // 0 for the current version
+	Version    int    `json:"version"`
+	Size       int64  `json:"size"`
+	MimeType   string `json:"mime_type"`
+	UploadedBy string `json:"uploaded_by"`
+	UploadedAt int64  `json:"uploaded_at"`
+	IsCurrent  bool   `json:"is_current"`
+}
+
+// Default for MAX_FILE_VERSIONS (old versions kept per file)
+const defaultMaxVersions = 10
+
+func maxVersions() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_FILE_VERSIONS")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultMaxVersions
+}
+
+// FindVersionTarget returns the existing file an upload of name into parentID
+// should become a new version of, or nil if it's a brand new file. Only the
+// caller's own file with the same visibility qualifies (guests: guest uploads):
+// promoting keeps the row's owner and is_public, so anything else would hand
+// the upload to someone else or publish it.
+func FindVersionTarget(name string, parentID *uint, userID uint, role string, isPublic bool) *FileMetadata {
+	query := DB.Where("name = ? AND is_folder = ? AND is_trash = ? AND status = ? AND is_public = ?", name, false, false, "completed", isPublic)
+	if parentID == nil {
+		query = query.Where("parent_id IS NULL")
+	} else {
+		query = query.Where("parent_id = ?", *parentID)
+	}
+	if role == "guest" || userID == 0 {
+		query = query.Where("user_id IS NULL")
+	} else {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var existing FileMetadata
+	// Find, not First: no match is the common case, not worth a log line
+	if query.Order("id asc").Limit(1).Find(&existing); existing.ID == 0 {
+		return nil
+	}
+	if !canWrite(existing, userID, role) {
+		return nil
+	}
+	return &existing
+}
+
+// snapshot turns the current state of a file into a version row
+func snapshot(file FileMetadata) FileVersion {
+	uploader, at := file.UserID, file.CreatedAt
+	if file.VersionAt != 0 {
+		uploader, at = file.VersionBy, file.VersionAt
+	}
+	return FileVersion{
+		FileID:    file.ID,
+		Version:   max(file.Version, 1),
+		S3Key:     file.S3Key,
+		Size:      file.Size,
+		MimeType:  file.MimeType,
+		ETag:      file.ETag,
+		UserID:    uploader,
+		CreatedAt: at,
+	}
+}
+
+// promoteVersion makes a verified pending upload the new current version of
+// the file it replaces. The old content goes into file_versions.
+func promoteVersion(pending *FileMetadata, etag string, mimeType string) error {
+	var fileID uint
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var current FileMetadata
+		if err := tx.First(&current, *pending.ReplacesID).Error; err != nil || current.IsTrash {
+			// Original is gone meanwhile: just keep the upload as a new file
+			return tx.Model(pending).Updates(map[string]interface{}{
+				"status": "completed", "upload_id": "", "etag": etag, "mime_type": mimeType, "replaces_id": nil,
+			}).Error
+		}
+		fileID = current.ID
+
+		archived := snapshot(current)
+		if err := tx.Create(&archived).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&current).Updates(map[string]interface{}{
+			"s3_key":     pending.S3Key,
+			"size":       pending.Size,
+			"etag":       etag,
+			"mime_type":  mimeType,
+			"version":    archived.Version + 1,
+			"version_by": pending.UserID,
+			"version_at": time.Now().Unix(),
+		}).Error; err != nil {
+			return err
+		}
+
+		// The pending row was only a carrier for the upload
+		return tx.Unscoped().Delete(pending).Error
+	})
+	if err == nil && fileID != 0 {
+		pruneVersions(fileID)
+	}
+	return err
+}
+
+// pruneVersions drops the oldest versions beyond MAX_FILE_VERSIONS,
+// queueing their objects for deletion. Failures only leave extra history
+// around until the next upload, so they're logged, not returned.
+func pruneVersions(fileID uint) {
+	var excess []FileVersion
+	if err := DB.Where("file_id = ?", fileID).Order("version desc").
+		Offset(maxVersions()).Limit(1000).Find(&excess).Error; err != nil || len(excess) == 0 {
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		ids := make([]uint, 0, len(excess))
+		queue := make([]PendingDeletion, 0, len(excess))
+		now := time.Now().Unix()
+		for _, v := range excess {
+			ids = append(ids, v.ID)
+			queue = append(queue, PendingDeletion{S3Key: v.S3Key, NextAttemptAt: now})
+		}
+		if err := tx.Create(&queue).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&FileVersion{}, ids).Error
+	})
+	if err != nil {
+		log.Printf("⚠️ Could not prune versions of file %d: %v\n", fileID, err)
+		return
+	}
+	WakeDeletionWorker()
+}
+
+// ListVersions returns a file's history, newest (current) first
+func ListVersions(fileID uint, userID uint, role string) ([]VersionInfo, error) {
+	var file FileMetadata
+	if err := DB.First(&file, fileID).Error; err != nil || file.IsFolder || !canRead(file, userID, role) {
+		return nil, errors.New("file not found")
+	}
+
+	var old []FileVersion
+	if err := DB.Where("file_id = ?", fileID).Order("version desc").Find(&old).Error; err != nil {
+		return nil, err
+	}
+
+	current := snapshot(file)
+	all := append([]FileVersion{current}, old...)
+
+	// Resolve uploader names in one go
+	var userIDs []uint
+	for _, v := range all {
+		if v.UserID != nil {
+			userIDs = append(userIDs, *v.UserID)
+		}
+	}
+	var users []User
+	if len(userIDs) > 0 {
+		DB.Where("id IN ?", userIDs).Find(&users)
+	}
+	names := map[uint]string{}
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+
+	infos := make([]VersionInfo, 0, len(all))
+	for i, v := range all {
+		uploader := "guest"
+		if v.UserID != nil {
+			uploader = names[*v.UserID]
+		}
+		infos = append(infos, VersionInfo{
+			ID:         v.ID,
+			Version:    v.Version,
+			Size:       v.Size,
+			MimeType:   v.MimeType,
+			UploadedBy: uploader,
+			UploadedAt: v.CreatedAt,
+			IsCurrent:  i == 0,
+		})
+	}
+	return infos, nil
+}
+
+// GetVersion loads an old version of a file the caller can see
+func GetVersion(fileID uint, versionID uint, userID uint, role string) (*FileMetadata, *FileVersion, error) {
+	var file FileMetadata
+	if err := DB.First(&file, fileID).Error; err != nil || !canRead(file, userID, role) {
+		return nil, nil, errors.New("file not found")
+	}
+	var version FileVersion
+	if err := DB.Where("id = ? AND file_id = ?", versionID, fileID).First(&version).Error; err != nil {
+		return nil, nil, errors.New("version not found")
+	}
+	return &file, &version, nil
+}
+
+// RestoreVersion makes an old version current again. Like an upload, this
+// creates a new version number; the replaced content goes into history.
+func RestoreVersion(fileID uint, versionID uint, userID uint, role string) (*FileMetadata, error) {
+	var file FileMetadata
+	if err := DB.First(&file, fileID).Error; err != nil || file.IsTrash {
+		return nil, errors.New("file not found")
+	}
+	if !canWrite(file, userID, role) {
+		return nil, errors.New("permission denied")
+	}
+
+	var version FileVersion
+	if err := DB.Where("id = ? AND file_id = ?", versionID, fileID).First(&version).Error; err != nil {
+		return nil, errors.New("version not found")
+	}
+
+	var userPtr *uint
+	if userID != 0 {
+		userPtr = &userID
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		archived := snapshot(file)
+		if err := tx.Create(&archived).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&file).Updates(map[string]interface{}{
+			"s3_key":     version.S3Key,
+			"size":       version.Size,
+			"etag":       version.ETag,
+			"mime_type":  version.MimeType,
+			"version":    archived.Version + 1,
+			"version_by": userPtr,
+			"version_at": time.Now().Unix(),
+		}).Error; err != nil {
+			return err
+		}
+
+		// Its object now belongs to the current version
+		return tx.Delete(&version).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pruneVersions(file.ID)
+	InvalidateCache(file.ParentID, userID)
+
+	DB.First(&file, file.ID)
+	return &file, nil
+}
+
+// versionKeys returns the objects of every old version of the given files
+func versionKeys(fileIDs []uint) []string {
+	var keys []string
+	for start := 0; start < len(fileIDs); start += 500 {
+		var batch []string
+		DB.Model(&FileVersion{}).Where("file_id IN ?", fileIDs[start:min(start+500, len(fileIDs))]).Pluck("s3_key", &batch)
+		keys = append(keys, batch...)
+	}
+	return keys
+}
@@ -0,0 +1,44 @@
+package database
+
+import "testing"
+
+func TestFindVersionTarget(t *testing.T) {
+	testDB(t)
+
+	alice, bob := uint(2), uint(3)
+	guestCopy := seedItem(t, FileMetadata{Name: "report.pdf", S3Key: "uploads/g", IsPublic: true})
+	bobCopy := seedItem(t, FileMetadata{Name: "report.pdf", S3Key: "uploads/b", UserID: &bob})
+	aliceCopy := seedItem(t, FileMetadata{Name: "notes.txt", S3Key: "uploads/a", UserID: &alice})
+	alicePublic := seedItem(t, FileMetadata{Name: "poster.png", S3Key: "uploads/p", UserID: &alice, IsPublic: true})
+	seedItem(t, FileMetadata{Name: "draft.txt", S3Key: "uploads/d", UserID: &alice, IsTrash: true})
+
+	tests := []struct {
+		name     string
+		file     string
+		userID   uint
+		role     string
+		isPublic bool
+		want     uint // 0 = new file
+	}{
+		{"admin's upload in root takes neither the guest's nor a user's file", "report.pdf", 1, "admin", false, 0},
+		{"admin's public upload in root doesn't take the guest's file", "report.pdf", 1, "admin", true, 0},
+		{"user's upload never replaces another user's file", "report.pdf", alice, "user", false, 0},
+		{"owner's upload replaces their own file", "report.pdf", bob, "user", false, bobCopy.ID},
+		{"guest upload replaces the guest file", "report.pdf", 0, "guest", true, guestCopy.ID},
+		{"owner on own file", "notes.txt", alice, "user", false, aliceCopy.ID},
+		{"private upload over own public file", "poster.png", alice, "user", false, 0},
+		{"public upload over own public file", "poster.png", alice, "user", true, alicePublic.ID},
+		{"trashed file isn't a target", "draft.txt", alice, "user", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got uint
+			if existing := FindVersionTarget(tt.file, nil, tt.userID, tt.role, tt.isPublic); existing != nil {
+				got = existing.ID
+			}
+			if got != tt.want {
+				t.Errorf("target = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
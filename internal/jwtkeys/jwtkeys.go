@@ -0,0 +1,245 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is one signing / verification key, named by its "kid"
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	sign   interface{} // []byte (HMAC) or a private key; nil = verify only
+	verify interface{} // []byte (HMAC) or a public key
+}
+
+var (
+	current *Key            // Signs new tokens
+	keys    map[string]*Key // kid -> key, current plus the ones still accepted
+)
+
+// HMAC secrets shorter than this are brute-forceable from any token
+const minSecretLen = 32
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+// Load reads the keys from the environment.
+//
+//	JWT_SECRET              HS256 secret (at least 32 characters)
+//	JWT_PRIVATE_KEY_FILE    PEM Ed25519 or RSA private key; signs with EdDSA / RS256 instead of JWT_SECRET
+//	JWT_KEY_ID              kid of the signing key (default: derived from the key)
+//	JWT_PREVIOUS_SECRETS    comma-separated old secrets, still accepted ("kid=secret" to pin a kid)
+//	JWT_PREVIOUS_KEY_FILES  comma-separated old PEM keys (private or public), still accepted and published
+//
+// Rotation: move the old key into JWT_PREVIOUS_*, set the new one, restart, and
+// drop the old key once the tokens it signed have expired (15 minutes).
+// With nothing set, a random secret is made so tokens don't outlive a restart.
+func Load() {
+	keys = map[string]*Key{}
+
+	var err error
+	switch {
+	case os.Getenv("JWT_PRIVATE_KEY_FILE") != "":
+		current, err = loadPEM(os.Getenv("JWT_PRIVATE_KEY_FILE"), os.Getenv("JWT_KEY_ID"))
+		if err == nil && current.sign == nil {
+			err = errors.New("JWT_PRIVATE_KEY_FILE holds a public key, a private key is needed to sign")
+		}
+	case os.Getenv("JWT_SECRET") != "":
+		current, err = hmacKey(os.Getenv("JWT_SECRET"), os.Getenv("JWT_KEY_ID"))
+	default:
+		log.Println("⚠️  JWT_SECRET not set, using a random one: everyone has to log in again after a restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("❌ JWT key: %v", err)
+		}
+		current, err = hmacKey(hex.EncodeToString(secret), "")
+	}
+	if err != nil {
+		log.Fatalf("❌ JWT key: %v", err)
+	}
+	keys[current.ID] = current
+
+	for _, s := range splitList(os.Getenv("JWT_PREVIOUS_SECRETS")) {
+		kid := ""
+		if i := strings.Index(s, "="); i > 0 {
+			kid, s = s[:i], s[i+1:]
+		}
+		if err := add(hmacKey(s, kid)); err != nil {
+			log.Fatalf("❌ JWT_PREVIOUS_SECRETS: %v", err)
+		}
+	}
+	for _, path := range splitList(os.Getenv("JWT_PREVIOUS_KEY_FILES")) {
+		if err := add(loadPEM(path, "")); err != nil {
+			log.Fatalf("❌ JWT_PREVIOUS_KEY_FILES: %v", err)
+		}
+	}
+
+	log.Printf("🔏 JWT signing with %s (kid %s), %d older key(s) accepted\n", current.Method.Alg(), current.ID, len(keys)-1)
+}
+
+func add(k *Key, err error) error {
+	if err != nil {
+		return err
+	}
+	if _, taken := keys[k.ID]; taken {
+		return fmt.Errorf("duplicate key id %q", k.ID)
+	}
+	keys[k.ID] = k
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// deriveID makes a stable kid from key material (a hash, never the key itself)
+func deriveID(material []byte) string {
+	sum := sha256.Sum256(material)
+	return hex.EncodeToString(sum[:8])
+}
+
+func hmacKey(secret string, kid string) (*Key, error) {
+	if len(secret) < minSecretLen {
+		return nil, fmt.Errorf("secret must be at least %d characters", minSecretLen)
+	}
+	if kid == "" {
+		kid = deriveID([]byte("hs256:" + secret))
+	}
+	return &Key{ID: kid, Method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}, nil
+}
+
+// loadPEM reads an Ed25519 or RSA key, private (PKCS#8 / PKCS#1) or public (PKIX)
+func loadPEM(path string, kid string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	k := &Key{ID: kid}
+	switch key := parsed.(type) {
+	case ed25519.PrivateKey:
+		k.Method, k.sign, k.verify = jwt.SigningMethodEdDSA, key, key.Public()
+	case ed25519.PublicKey:
+		k.Method, k.verify = jwt.SigningMethodEdDSA, key
+	case *rsa.PrivateKey:
+		k.Method, k.sign, k.verify = jwt.SigningMethodRS256, key, &key.PublicKey
+	case *rsa.PublicKey:
+		k.Method, k.verify = jwt.SigningMethodRS256, key
+	default:
+		return nil, fmt.Errorf("%s: only Ed25519 and RSA keys are supported", path)
+	}
+	if rsaKey, ok := k.verify.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("%s: RSA keys must be at least 2048 bits", path)
+	}
+
+	if k.ID == "" {
+		der, err := x509.MarshalPKIXPublicKey(k.verify)
+		if err != nil {
+			return nil, err
+		}
+		k.ID = deriveID(der)
+	}
+	return k, nil
+}
+
+// Sign issues a token with the current key, its kid in the header
+func Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(current.Method, claims)
+	token.Header["kid"] = current.ID
+	return token.SignedString(current.sign)
+}
+
+// Parse verifies a token against the key its kid names. The algorithm must be
+// that key's own, so a public key can't be passed off as an HMAC secret.
+func Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := keys[kid]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		if t.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return k.verify, nil
+	})
+}
+
+// JWKS is the public half of every asymmetric key, for other services to
+// verify our tokens (HMAC secrets are never published)
+func JWKS() map[string]interface{} {
+	list := []map[string]string{}
+	for _, k := range sortedKeys() {
+		jwk := map[string]string{"kid": k.ID, "alg": k.Method.Alg(), "use": "sig"}
+		switch pub := k.verify.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"], jwk["crv"], jwk["x"] = "OKP", "Ed25519", b64(pub)
+		case *rsa.PublicKey:
+			jwk["kty"], jwk["n"], jwk["e"] = "RSA", b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+		list = append(list, jwk)
+	}
+	return map[string]interface{}{"keys": list}
+}
+
+// sortedKeys puts the current key first, the rest by kid (stable output)
+func sortedKeys() []*Key {
+	out := []*Key{current}
+	var rest []string
+	for id := range keys {
+		if id != current.ID {
+			rest = append(rest, id)
+		}
+	}
+	sort.Strings(rest)
+	for _, id := range rest {
+		out = append(out, keys[id])
+	}
+	return out
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
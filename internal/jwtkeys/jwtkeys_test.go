@@ -0,0 +1,128 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	secretA = "first-secret-that-is-long-enough-000"
+	secretB = "second-secret-that-is-long-enough-11"
+)
+
+// load runs Load with only the given JWT_* variables set
+func load(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range []string{"JWT_SECRET", "JWT_PRIVATE_KEY_FILE", "JWT_KEY_ID", "JWT_PREVIOUS_SECRETS", "JWT_PREVIOUS_KEY_FILES"} {
+		t.Setenv(name, env[name])
+	}
+	Load()
+}
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "1", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+// writeEd25519 saves a fresh private key as PEM and returns its path and public key
+func writeEd25519(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+func TestParseRejectsOtherAlgorithms(t *testing.T) {
+	keyFile, pub := writeEd25519(t)
+	load(t, map[string]string{"JWT_PRIVATE_KEY_FILE": keyFile, "JWT_PREVIOUS_SECRETS": "old=" + secretA})
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+
+	// forge signs claims with method and key, claiming to come from kid
+	forge := func(method jwt.SigningMethod, key interface{}, kid string) string {
+		token := jwt.NewWithClaims(method, claims())
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"current key", mustSign(t), false},
+		{"HMAC keyed with the public key, under the EdDSA kid", forge(jwt.SigningMethodHS256, pubDER, current.ID), true},
+		{"HMAC keyed with the raw public key, under the EdDSA kid", forge(jwt.SigningMethodHS256, []byte(pub), current.ID), true},
+		{"HS384 under an HS256 kid", forge(jwt.SigningMethodHS384, []byte(secretA), "old"), true},
+		{"HS256 under its own kid", forge(jwt.SigningMethodHS256, []byte(secretA), "old"), false},
+		{"unknown kid", forge(jwt.SigningMethodHS256, []byte(secretA), "nope"), true},
+		{"no kid", forge(jwt.SigningMethodHS256, []byte(secretA), ""), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	load(t, map[string]string{"JWT_SECRET": secretA})
+	old := mustSign(t)
+	oldKid := current.ID
+
+	// New secret, the old one kept for the tokens it already signed
+	load(t, map[string]string{"JWT_SECRET": secretB, "JWT_PREVIOUS_SECRETS": secretA})
+	if current.ID == oldKid {
+		t.Fatal("new key has the old key's kid")
+	}
+	if _, err := Parse(old); err != nil {
+		t.Errorf("token from before the rotation: %v", err)
+	}
+	fresh := mustSign(t)
+	token, err := Parse(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != current.ID {
+		t.Errorf("new token signed with kid %v, want %s", token.Header["kid"], current.ID)
+	}
+
+	// Old key dropped: its tokens stop working, new ones don't
+	load(t, map[string]string{"JWT_SECRET": secretB})
+	if _, err := Parse(old); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token of a dropped key: err = %v, want ErrUnknownKey", err)
+	}
+	if _, err := Parse(fresh); err != nil {
+		t.Errorf("token of the current key: %v", err)
+	}
+}
+
+func mustSign(t *testing.T) string {
+	t.Helper()
+	s, err := Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
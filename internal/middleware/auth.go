@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+	"s3-drive/internal/database"
+	"s3-drive/internal/jwtkeys"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// AccessToken checks a JWT the way every authenticated request needs it checked:
+// signature, an access token (2FA challenges and share tokens carry a "typ"),
+// a live session, and the account's current role (disabled, deleted or
+// demoted since the token was issued counts).
+func AccessToken(tokenString string) (uint, string, uint, error) {
+	token, err := jwtkeys.Parse(tokenString)
+	if err != nil || !token.Valid {
+		return 0, "", 0, ErrInvalidToken
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	sub, okSub := claims["sub"].(float64)
+	role, okRole := claims["role"].(string)
+	if !okSub || !okRole || claims["typ"] != nil {
+		return 0, "", 0, ErrInvalidToken
+	}
+	userID := uint(sub)
+
+	// Logged out / revoked sessions stop working right away, not when the token expires
+	sid, ok := claims["sid"].(float64)
+	if !ok || database.ActiveSession(uint(sid), userID) != nil {
+		return 0, "", 0, database.ErrSessionInvalid
+	}
+
+	if role != "guest" {
+		user, err := database.ActiveUser(userID)
+		if err != nil {
+			return 0, "", 0, ErrInvalidToken
+		}
+		role = user.Role
+	}
+	return userID, role, uint(sid), nil
+}
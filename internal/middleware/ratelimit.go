@@ -1,18 +1,23 @@
 package middleware
 
 import (
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"s3-drive/internal/database"
 )
 
 // Define the limit rules
 const (
 	GuestLimit    = 100             // Max requests
 	GuestWindow   = 1 * time.Hour   // Per this duration
+	UserLimit     = 5000            // Signed-in accounts and API tokens, per account (same window)
 )
 
 type ClientRate struct {
@@ -21,74 +26,150 @@ type ClientRate struct {
 }
 
 var (
-	// Map to store IP -> Rate Info
+	// Map to store IP (or account) -> Rate Info
 	clients = make(map[string]*ClientRate)
 	mu      sync.Mutex
 )
 
-// RateLimitMiddleware checks usage for GUESTS only
-// It requires the "role" to be in the context, so put this INSIDE AuthMiddleware or verify token manually if Auth isn't strictly required yet.
-// However, since we apply it to routes that might NOT be authed yet (like guest login), 
-// we generally use IP address.
-func RateLimit(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		
-		// 1. Identify the User (Admin vs Guest)
-		// We try to peek at the token to see if it's an admin.
-		// If no token or invalid token, we treat them as a "Potential Guest" and limit by IP.
-		isAdmin := false
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != "" {
-			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-			// We parse insecurely just to check the role claim quickly
-			token, _, _ := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
-			if token != nil {
-				if claims, ok := token.Claims.(jwt.MapClaims); ok {
-					if role, ok := claims["role"].(string); ok && role == "admin" {
-						isAdmin = true
-					}
-				}
-			}
+// identify picks the bucket a request counts against. Only a valid token with
+// a live session gets out of the per-IP guest bucket: admins aren't limited (limit 0),
+// users and API tokens get their own per-account bucket.
+func identify(r *http.Request) (string, int) {
+	guest := "ip:" + ClientIP(r)
+
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tokenString == "" {
+		return guest, GuestLimit
+	}
+
+	// Personal API tokens: counted against their account
+	if strings.HasPrefix(tokenString, database.APITokenPrefix) {
+		apiToken, err := database.AuthenticateAPIToken(tokenString)
+		if err != nil {
+			return guest, GuestLimit
+		}
+		user, err := database.ActiveUser(apiToken.UserID)
+		if err != nil {
+			return guest, GuestLimit
+		}
+		if user.Role == database.RoleAdmin {
+			return "", 0
 		}
+		return fmt.Sprintf("user:%d", user.ID), UserLimit
+	}
+
+	// Same checks as authMiddleware: a revoked session or a demoted admin is no exemption
+	userID, role, _, err := AccessToken(tokenString)
+	if err != nil {
+		return guest, GuestLimit
+	}
+	switch role {
+	case database.RoleAdmin:
+		return "", 0
+	case "guest":
+		return guest, GuestLimit // One shared guest account: still per IP
+	}
+	return fmt.Sprintf("user:%d", userID), UserLimit
+}
 
-		// 2. Skip Limits for Admin
-		if isAdmin {
+// RateLimit counts requests per IP for guests and anonymous callers, per
+// account for signed-in users and API tokens; admins are not limited.
+func RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, limit := identify(r)
+		if limit == 0 {
 			next(w, r)
 			return
 		}
+		if !Allow(key, limit) {
+			http.Error(w, fmt.Sprintf("429 Too Many Requests (Limit: %d/hr)", limit), http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Allow counts one request against key and reports whether it's within limit per GuestWindow
+func Allow(key string, limit int) bool {
+	mu.Lock()
+	defer mu.Unlock()
 
-		// 3. Enforce Limit for Guests (by IP)
-		ip := r.RemoteAddr
-		// If behind a proxy (like Nginx/Cloudflare), use X-Forwarded-For
-		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
-			ip = strings.Split(fwd, ",")[0]
+	client, exists := clients[key]
+
+	// Initialize if new or if window expired
+	if !exists || time.Now().After(client.ResetTime) {
+		clients[key] = &ClientRate{
+			Count:     1,
+			ResetTime: time.Now().Add(GuestWindow),
 		}
+		return true
+	}
 
-		mu.Lock()
-		defer mu.Unlock()
+	// Check Limit
+	if client.Count >= limit {
+		return false
+	}
 
-		client, exists := clients[ip]
-		
-		// Initialize if new or if window expired
-		if !exists || time.Now().After(client.ResetTime) {
-			clients[ip] = &ClientRate{
-				Count:     1,
-				ResetTime: time.Now().Add(GuestWindow),
+	// Increment
+	client.Count++
+	return true
+}
+
+// Proxies whose X-Forwarded-For is believed. Anyone else can put any IP in
+// that header, so without this list it's ignored.
+var trustedProxies []*net.IPNet
+
+// LoadTrustedProxies reads TRUSTED_PROXIES: comma-separated IPs or CIDRs
+// (e.g. "10.0.0.0/8,127.0.0.1" for an ingress in the cluster)
+func LoadTrustedProxies() {
+	trustedProxies = nil
+	for _, s := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			s = ip.String() + "/32"
+			if ip.To4() == nil {
+				s = ip.String() + "/128"
 			}
-			next(w, r)
-			return
 		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("⚠️ TRUSTED_PROXIES: ignoring %q", s)
+			continue
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+}
 
-		// Check Limit
-		if client.Count >= GuestLimit {
-			http.Error(w, "429 Too Many Requests (Guest Limit: 100/hr)", http.StatusTooManyRequests)
-			return
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
 		}
+	}
+	return false
+}
 
-		// Increment
-		client.Count++
-		next(w, r)
+// ClientIP is the caller's address. Behind trusted proxies (like Nginx/Cloudflare)
+// it's the last X-Forwarded-For hop they didn't add themselves.
+func ClientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0 && trustedProxy(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
 	}
+	return ip
 }
 
 // ... (Previous code)
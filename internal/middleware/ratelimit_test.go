@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"s3-drive/internal/database"
+	"s3-drive/internal/jwtkeys"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 127.0.0.1")
+	LoadTrustedProxies()
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "203.0.113.7:4000", "", "203.0.113.7"},
+		{"forged header from an untrusted caller", "203.0.113.7:4000", "1.2.3.4", "203.0.113.7"},
+		{"through the proxy", "10.1.2.3:80", "198.51.100.9", "198.51.100.9"},
+		{"spoofed hop before the proxy's", "10.1.2.3:80", "1.2.3.4, 198.51.100.9", "198.51.100.9"},
+		{"chain of trusted proxies", "127.0.0.1:80", "198.51.100.9, 10.9.9.9", "198.51.100.9"},
+		{"garbage hop", "10.1.2.3:80", "not-an-ip", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	t.Chdir(t.TempDir())
+	database.Connect()
+	jwtkeys.Load()
+
+	admin := database.User{Username: "root", Role: database.RoleAdmin}
+	database.DB.Create(&admin)
+	session, _, _ := database.CreateSession(admin.ID, admin.Role, "", "")
+	token, _ := jwtkeys.Sign(jwt.MapClaims{"sub": admin.ID, "role": "admin", "sid": session.ID, "exp": time.Now().Add(time.Hour).Unix()})
+
+	bucket := func() (string, int) {
+		r := httptest.NewRequest("GET", "/api/files", nil)
+		r.RemoteAddr = "203.0.113.7:4000"
+		r.Header.Set("Authorization", "Bearer "+token)
+		return identify(r)
+	}
+
+	if key, limit := bucket(); key != "" || limit != 0 {
+		t.Errorf("admin: %q %d, want exempt", key, limit)
+	}
+
+	// Demoted: the token still says admin, the account doesn't
+	database.DB.Model(&admin).Update("role", database.RoleUser)
+	if key, limit := bucket(); key != "user:1" || limit != UserLimit {
+		t.Errorf("demoted admin: %q %d, want the user bucket", key, limit)
+	}
+
+	database.DB.Model(&admin).Update("role", database.RoleAdmin)
+	database.RevokeSession(session.ID, admin.ID)
+	if key, limit := bucket(); key != "ip:203.0.113.7" || limit != GuestLimit {
+		t.Errorf("revoked session: %q %d, want the guest bucket", key, limit)
+	}
+}
@@ -0,0 +1,210 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Provider is the configured OpenID Connect issuer, nil when OIDC_ISSUER_URL
+// is unset (password login only)
+var Provider *OIDC
+
+// How long a user has to finish logging in at the provider
+const loginTimeout = 10 * time.Minute
+
+type OIDC struct {
+	config      oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	groupsClaim string
+	adminGroups map[string]bool
+
+	mu      sync.Mutex
+	pending map[string]loginState // state -> what the callback needs to finish
+}
+
+type loginState struct {
+	verifier string // PKCE code verifier
+	nonce    string
+	expires  time.Time
+}
+
+// Identity is what we learned about the user from a verified ID token
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string // preferred_username, if the provider sends one
+	Groups        []string
+	Role          string // "admin" / "user" from OIDC_ADMIN_GROUPS, "" if no mapping is configured
+}
+
+var ErrLoginExpired = errors.New("login expired or unknown, start again")
+
+// Connect discovers the issuer (OIDC_ISSUER_URL) and sets up the client.
+//
+//	OIDC_CLIENT_ID / OIDC_CLIENT_SECRET  client registered at the provider (secret optional with PKCE)
+//	OIDC_REDIRECT_URL                    https://<host>/api/oidc/callback
+//	OIDC_SCOPES                          extra scopes besides "openid profile email" (e.g. "groups")
+//	OIDC_GROUPS_CLAIM                    claim holding the user's groups (default "groups")
+//	OIDC_ADMIN_GROUPS                    comma-separated groups that make someone admin
+func Connect() {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return
+	}
+
+	p, err := New(context.Background(), issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), os.Getenv("OIDC_REDIRECT_URL"))
+	if err != nil {
+		log.Fatalf("❌ OIDC setup failed: %v", err)
+	}
+	p.config.Scopes = append(p.config.Scopes, strings.Fields(os.Getenv("OIDC_SCOPES"))...)
+	if claim := os.Getenv("OIDC_GROUPS_CLAIM"); claim != "" {
+		p.groupsClaim = claim
+	}
+	for _, g := range strings.Split(os.Getenv("OIDC_ADMIN_GROUPS"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			p.adminGroups[g] = true
+		}
+	}
+
+	Provider = p
+	log.Printf("🔑 OIDC login enabled (%s)\n", issuer)
+}
+
+// New talks to the issuer's discovery document; Connect wraps it with the env config
+func New(ctx context.Context, issuer string, clientID string, clientSecret string, redirectURL string) (*OIDC, error) {
+	if clientID == "" || redirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required")
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDC{
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier:    provider.Verifier(&oidc.Config{ClientID: clientID}),
+		groupsClaim: "groups",
+		adminGroups: map[string]bool{},
+		pending:     map[string]loginState{},
+	}, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthURL starts a login: it returns the state (to pin in a cookie) and the
+// provider URL to send the browser to, with a PKCE S256 challenge and a nonce
+func (p *OIDC) AuthURL() (string, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	p.mu.Lock()
+	now := time.Now()
+	for s, l := range p.pending { // Forget logins nobody finished
+		if now.After(l.expires) {
+			delete(p.pending, s)
+		}
+	}
+	p.pending[state] = loginState{verifier: verifier, nonce: nonce, expires: now.Add(loginTimeout)}
+	p.mu.Unlock()
+
+	url := p.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return state, url, nil
+}
+
+// Exchange finishes a login: trades the code (with the PKCE verifier) for
+// tokens and verifies the ID token's signature, audience, expiry and nonce
+func (p *OIDC) Exchange(ctx context.Context, state string, code string) (*Identity, error) {
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state) // One shot
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return nil, ErrLoginExpired
+	}
+
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %w", err)
+	}
+	rawID, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("provider returned no id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if idToken.Nonce != login.nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	id := &Identity{Subject: idToken.Subject}
+	id.Email, _ = claims["email"].(string)
+	id.EmailVerified, _ = claims["email_verified"].(bool)
+	id.Username, _ = claims["preferred_username"].(string)
+	id.Groups = stringList(claims[p.groupsClaim])
+
+	if len(p.adminGroups) > 0 {
+		id.Role = "user"
+		for _, g := range id.Groups {
+			if p.adminGroups[g] {
+				id.Role = "admin"
+			}
+		}
+	}
+	return id, nil
+}
+
+// stringList reads a claim that may be a list or a single string
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Backend is everything the server needs from an object store.
+// S3 (and anything S3-compatible) is the default; the local driver
+// keeps objects on disk and serves its own signed URLs.
+type Backend interface {
+	// GeneratePutURL returns a URL the browser can PUT exactly sizeLimit bytes to.
+	GeneratePutURL(key string, sizeLimit int64) (string, error)
+	// GenerateGetURL returns a URL that downloads the object as downloadName.
+	GenerateGetURL(key string, downloadName string) (string, error)
+
+	DeleteFile(key string) error
+	// DeleteMultiple always returns a report; the error is non-nil if any key failed.
+	DeleteMultiple(keys []string) (*DeleteReport, error)
+
+	// HeadObject returns ErrNotFound if the key does not exist.
+	HeadObject(key string) (*ObjectInfo, error)
+	// ListObjects returns one page of keys under prefix. Pass the previous
+	// page's NextToken to continue; an empty NextToken means the listing is done.
+	ListObjects(prefix string, token string) (*ObjectPage, error)
+	// GetObject streams an object through the server (zip downloads).
+	// Returns ErrNotFound if the key does not exist; the caller closes the reader.
+	GetObject(key string) (io.ReadCloser, error)
+	// CopyObject duplicates an object inside the store (any size).
+	CopyObject(srcKey string, dstKey string) error
+
+	// Multipart uploads (for files over MaxSinglePutSize)
+	CreateMultipartUpload(key string) (string, error)
+	// GeneratePartURL returns a URL the browser can PUT exactly size bytes to;
+	// the response's ETag header is what CompleteMultipartUpload needs back.
+	GeneratePartURL(key string, uploadID string, partNumber int32, size int64) (string, error)
+	CompleteMultipartUpload(key string, uploadID string, parts []CompletedPart) error
+	AbortMultipartUpload(key string, uploadID string) error
+	// ListParts reports the parts that have landed so far (for resuming).
+	// Returns ErrNotFound if the upload was completed, aborted or expired.
+	ListParts(key string, uploadID string) ([]UploadedPart, error)
+}
+
+// ObjectInfo is the subset of object metadata we care about
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+type ObjectPage struct {
+	Objects   []ObjectInfo
+	NextToken string
+}
+
+// ErrNotFound is returned by HeadObject when the key is missing
+var ErrNotFound = errors.New("object not found")
+
+// URLExpiry is how long presigned URLs stay valid
+const URLExpiry = 15 * time.Minute
+
+// Store is the active backend, picked by Connect()
+var Store Backend
+
+// --- CONNECT ---
+// STORAGE_BACKEND=local keeps files on disk (no bucket needed),
+// anything else (or unset) uses S3.
+func Connect() {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "local":
+		Store = connectLocal()
+	case "", "s3":
+		Store = connectS3()
+	default:
+		log.Fatalf("❌ Unknown STORAGE_BACKEND %q (use \"s3\" or \"local\")", os.Getenv("STORAGE_BACKEND"))
+	}
+}
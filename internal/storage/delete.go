@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- BATCH DELETE LIMITS ---
+const (
+	deleteBatchSize   = 1000 // S3 DeleteObjects max
+	deleteConcurrency = 4    // Batches in flight at once
+	deleteRetries     = 3    // Extra attempts for keys that failed
+	deleteBackoff     = 200 * time.Millisecond
+)
+
+// DeleteFailure is a key that still failed after all retries
+type DeleteFailure struct {
+	Key string
+	Err error
+}
+
+// DeleteReport says which keys of a DeleteMultiple call are gone and which aren't
+type DeleteReport struct {
+	Deleted []string
+	Failed  []DeleteFailure
+}
+
+// FailedKeys is just the keys of Failed, for callers that want to try again later
+func (r *DeleteReport) FailedKeys() []string {
+	keys := make([]string, 0, len(r.Failed))
+	for _, f := range r.Failed {
+		keys = append(keys, f.Key)
+	}
+	return keys
+}
+
+// deleteInBatches splits keys into batches, runs them with bounded concurrency,
+// and retries (with backoff) only the keys that came back with an error.
+// deleteBatch returns the keys of its batch that failed, and why.
+func deleteInBatches(keys []string, deleteBatch func(batch []string) map[string]error) (*DeleteReport, error) {
+	report := &DeleteReport{}
+	if len(keys) == 0 {
+		return report, nil
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, deleteConcurrency)
+	)
+
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		batch := keys[start:min(start+deleteBatchSize, len(keys))]
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			pending := batch
+			var failed map[string]error
+			for attempt := 0; attempt <= deleteRetries && len(pending) > 0; attempt++ {
+				if attempt > 0 {
+					time.Sleep(deleteBackoff << (attempt - 1))
+				}
+
+				failed = deleteBatch(pending)
+
+				var retry []string
+				mu.Lock()
+				for _, k := range pending {
+					if _, bad := failed[k]; bad {
+						retry = append(retry, k)
+					} else {
+						report.Deleted = append(report.Deleted, k)
+					}
+				}
+				mu.Unlock()
+				pending = retry
+			}
+
+			mu.Lock()
+			for _, k := range pending {
+				report.Failed = append(report.Failed, DeleteFailure{Key: k, Err: failed[k]})
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(report.Failed) > 0 {
+		first := report.Failed[0]
+		return report, fmt.Errorf("%d of %d deletes failed (first: %s: %w)", len(report.Failed), len(keys), first.Key, first.Err)
+	}
+	return report, nil
+}
+
+// errAll marks every key of a batch as failed with the same error
+func errAll(keys []string, err error) map[string]error {
+	failed := make(map[string]error, len(keys))
+	for _, k := range keys {
+		failed[k] = err
+	}
+	return failed
+}
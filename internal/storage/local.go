@@ -0,0 +1,571 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalRoute is where the local driver's signed URLs point.
+// main.go mounts the backend here when it implements http.Handler.
+const LocalRoute = "/api/storage/"
+
+// Page size for ListObjects, same as S3's default
+const localListPageSize = 1000
+
+// LocalBackend keeps objects on disk under Root and plays the part of S3
+// itself: presigned URLs point back at this server and are checked with an HMAC.
+type LocalBackend struct {
+	Root    string // objects live at Root/<key>, metadata at Root/.meta/<key>.json
+	BaseURL string // public address of this server, e.g. https://drive.example.com
+	secret  []byte
+}
+
+// Sidecar metadata (S3 keeps this for us, on disk we have to)
+type localMeta struct {
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+}
+
+// --- CONNECT ---
+func connectLocal() *LocalBackend {
+	root := os.Getenv("LOCAL_STORAGE_PATH")
+	if root == "" {
+		root = "data"
+	}
+	if err := os.MkdirAll(filepath.Join(root, ".meta"), 0o755); err != nil {
+		log.Fatalf("❌ Unable to create local storage dir, %v", err)
+	}
+
+	baseURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if baseURL == "" {
+		baseURL = "http://localhost"
+	}
+
+	// Without a fixed secret, links just stop working after a restart (they only live 15 min anyway)
+	secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	log.Printf("📂 Using local storage at %s (no bucket)\n", root)
+	return &LocalBackend{Root: root, BaseURL: baseURL, secret: secret}
+}
+
+// --- PATH HELPERS ---
+
+func (b *LocalBackend) objectPath(key string) (string, error) {
+	// Keys come from us ("uploads/<uuid>"), but never trust them with the filesystem
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasPrefix(key, ".") || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(b.Root, filepath.FromSlash(key)), nil
+}
+
+func (b *LocalBackend) metaPath(key string) string {
+	return filepath.Join(b.Root, ".meta", filepath.FromSlash(key)+".json")
+}
+
+func (b *LocalBackend) readMeta(key string) localMeta {
+	var meta localMeta
+	if data, err := os.ReadFile(b.metaPath(key)); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+func (b *LocalBackend) writeMeta(key string, meta localMeta) error {
+	path := b.metaPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(meta)
+	return os.WriteFile(path, data, 0o644)
+}
+
+// --- SIGNING ---
+
+func (b *LocalBackend) sign(method, key string, exp int64, extra string) string {
+	mac := hmac.New(sha256.New, b.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, key, exp, extra)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *LocalBackend) signedURL(method, key string, params url.Values, extra string) string {
+	exp := time.Now().Add(URLExpiry).Unix()
+	params.Set("exp", strconv.FormatInt(exp, 10))
+	params.Set("sig", b.sign(method, key, exp, extra))
+	return b.BaseURL + LocalRoute + key + "?" + params.Encode()
+}
+
+// --- GENERATE UPLOAD URL (WITH HARD LIMIT) ---
+func (b *LocalBackend) GeneratePutURL(key string, sizeLimit int64) (string, error) {
+	if _, err := b.objectPath(key); err != nil {
+		return "", err
+	}
+	size := strconv.FormatInt(sizeLimit, 10)
+	return b.signedURL(http.MethodPut, key, url.Values{"size": {size}}, size), nil
+}
+
+// --- GENERATE DOWNLOAD URL (WITH PRETTY NAME) ---
+func (b *LocalBackend) GenerateGetURL(key string, downloadName string) (string, error) {
+	if _, err := b.objectPath(key); err != nil {
+		return "", err
+	}
+	return b.signedURL(http.MethodGet, key, url.Values{"name": {downloadName}}, downloadName), nil
+}
+
+// --- DELETE ---
+func (b *LocalBackend) DeleteFile(key string) error {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return err
+	}
+	// Like S3: deleting something that isn't there is not an error
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	os.Remove(b.metaPath(key))
+	return nil
+}
+
+// --- BATCH DELETE ---
+func (b *LocalBackend) DeleteMultiple(keys []string) (*DeleteReport, error) {
+	return deleteInBatches(keys, func(batch []string) map[string]error {
+		failed := make(map[string]error)
+		for _, k := range batch {
+			if err := b.DeleteFile(k); err != nil {
+				failed[k] = err
+			}
+		}
+		return failed
+	})
+}
+
+// --- HEAD ---
+func (b *LocalBackend) HeadObject(key string) (*ObjectInfo, error) {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := b.readMeta(key)
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ETag:         meta.ETag,
+		ContentType:  meta.ContentType,
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// --- LIST (ONE PAGE) ---
+// The token is simply the last key of the previous page.
+func (b *LocalBackend) ListObjects(prefix string, token string) (*ObjectPage, error) {
+	var keys []string
+	err := filepath.WalkDir(b.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != b.Root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir // .meta and temp dirs
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil // in-flight uploads
+		}
+		rel, err := filepath.Rel(b.Root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	page := &ObjectPage{}
+	if len(keys) > localListPageSize {
+		keys = keys[:localListPageSize]
+		page.NextToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		info, err := b.HeadObject(k)
+		if err != nil {
+			continue // deleted while we were walking
+		}
+		page.Objects = append(page.Objects, *info)
+	}
+	return page, nil
+}
+
+// --- GET (STREAM) ---
+func (b *LocalBackend) GetObject(key string) (io.ReadCloser, error) {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// --- SERVER-SIDE COPY ---
+func (b *LocalBackend) CopyObject(srcKey string, dstKey string) error {
+	src, err := b.objectPath(srcKey)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := b.writeObject(dstKey, in); err != nil {
+		return err
+	}
+	return b.writeMeta(dstKey, b.readMeta(srcKey))
+}
+
+// writeObject stores r under key. Returns the MD5 ETag.
+func (b *LocalBackend) writeObject(key string, r io.Reader) (string, error) {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return "", err
+	}
+	return writeFile(path, r)
+}
+
+// writeFile streams r into a temp file next to path and renames it
+// into place, so readers never see half-written files.
+func writeFile(path string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// --- HTTP HANDLER (the "bucket" endpoint) ---
+// Serves the URLs handed out by GeneratePutURL / GenerateGetURL.
+func (b *LocalBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, LocalRoute)
+	q := r.URL.Query()
+
+	exp, _ := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if exp == 0 || time.Now().Unix() > exp {
+		http.Error(w, "URL expired", 403)
+		return
+	}
+
+	var extra string
+	switch r.Method {
+	case http.MethodPut:
+		extra = q.Get("size")
+		if q.Has("uploadId") {
+			extra = partExtra(q.Get("uploadId"), q.Get("partNumber"), q.Get("size"))
+		}
+	case http.MethodGet, http.MethodHead:
+		extra = q.Get("name")
+	default:
+		http.Error(w, "GET or PUT only", 405)
+		return
+	}
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	expected := b.sign(method, key, exp, extra)
+	if !hmac.Equal([]byte(expected), []byte(q.Get("sig"))) {
+		http.Error(w, "Invalid signature", 403)
+		return
+	}
+
+	if r.Method == http.MethodPut && q.Has("uploadId") {
+		b.servePart(w, r, key, q.Get("uploadId"), q.Get("partNumber"), q.Get("size"))
+		return
+	}
+	if r.Method == http.MethodPut {
+		b.servePut(w, r, key, extra)
+		return
+	}
+	b.serveGet(w, r, key, extra)
+}
+
+func (b *LocalBackend) servePut(w http.ResponseWriter, r *http.Request, key string, rawSize string) {
+	// 🔒 Same rule as the S3 presign: the body must be exactly the signed size
+	size, _ := strconv.ParseInt(rawSize, 10, 64)
+	if r.ContentLength != size {
+		http.Error(w, "Content-Length does not match signed size", 403)
+		return
+	}
+
+	etag, err := b.writeObject(key, http.MaxBytesReader(w, r.Body, size))
+	if err != nil {
+		http.Error(w, "Upload failed", 500)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := b.writeMeta(key, localMeta{ContentType: contentType, ETag: etag}); err != nil {
+		http.Error(w, "Upload failed", 500)
+		return
+	}
+
+	w.Header().Set("ETag", "\""+etag+"\"")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (b *LocalBackend) serveGet(w http.ResponseWriter, r *http.Request, key string, downloadName string) {
+	path, err := b.objectPath(key)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ct := b.readMeta(key).ContentType; ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", downloadName))
+	http.ServeContent(w, r, downloadName, fi.ModTime(), f)
+}
+
+// --- MULTIPART ---
+// Parts are kept in Root/.multipart/<uploadID>/ until Complete stitches them together.
+
+func (b *LocalBackend) uploadDir(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", fmt.Errorf("invalid upload id %q", uploadID)
+	}
+	return filepath.Join(b.Root, ".multipart", uploadID), nil
+}
+
+// openUpload checks the upload exists and belongs to key
+func (b *LocalBackend) openUpload(key string, uploadID string) (string, error) {
+	dir, err := b.uploadDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+	owner, err := os.ReadFile(filepath.Join(dir, "key"))
+	if err != nil || string(owner) != key {
+		return "", ErrNotFound
+	}
+	return dir, nil
+}
+
+func partFile(dir string, partNumber int32) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d", partNumber))
+}
+
+func partExtra(uploadID, partNumber, size string) string {
+	return uploadID + "\n" + partNumber + "\n" + size
+}
+
+func (b *LocalBackend) CreateMultipartUpload(key string) (string, error) {
+	if _, err := b.objectPath(key); err != nil {
+		return "", err
+	}
+
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	uploadID := hex.EncodeToString(raw)
+
+	dir, _ := b.uploadDir(uploadID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key"), []byte(key), 0o644); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (b *LocalBackend) GeneratePartURL(key string, uploadID string, partNumber int32, size int64) (string, error) {
+	if _, err := b.openUpload(key, uploadID); err != nil {
+		return "", err
+	}
+	number := strconv.Itoa(int(partNumber))
+	rawSize := strconv.FormatInt(size, 10)
+	params := url.Values{"uploadId": {uploadID}, "partNumber": {number}, "size": {rawSize}}
+	return b.signedURL(http.MethodPut, key, params, partExtra(uploadID, number, rawSize)), nil
+}
+
+func (b *LocalBackend) CompleteMultipartUpload(key string, uploadID string, parts []CompletedPart) error {
+	dir, err := b.openUpload(key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var readers []io.Reader
+	for _, p := range parts {
+		etag, err := os.ReadFile(partFile(dir, p.Number) + ".etag")
+		if err != nil {
+			return fmt.Errorf("part %d was never uploaded", p.Number)
+		}
+		if string(etag) != strings.Trim(p.ETag, "\"") {
+			return fmt.Errorf("part %d etag mismatch", p.Number)
+		}
+		f, err := os.Open(partFile(dir, p.Number))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	etag, err := b.writeObject(key, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+
+	contentType, _ := os.ReadFile(filepath.Join(dir, "content-type"))
+	if len(contentType) == 0 {
+		contentType = []byte("application/octet-stream")
+	}
+	if err := b.writeMeta(key, localMeta{ContentType: string(contentType), ETag: etag}); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (b *LocalBackend) AbortMultipartUpload(key string, uploadID string) error {
+	dir, err := b.openUpload(key, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (b *LocalBackend) ListParts(key string, uploadID string) ([]UploadedPart, error) {
+	dir, err := b.openUpload(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts by name, and part files are zero-padded, so this is in part order
+	var parts []UploadedPart
+	for _, e := range entries {
+		number, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue // "key", "content-type", *.etag, temp files
+		}
+		etag, err := os.ReadFile(filepath.Join(dir, e.Name()+".etag"))
+		if err != nil {
+			continue // still being written
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		parts = append(parts, UploadedPart{Number: int32(number), Size: fi.Size(), ETag: string(etag)})
+	}
+	return parts, nil
+}
+
+func (b *LocalBackend) servePart(w http.ResponseWriter, r *http.Request, key, uploadID, rawNumber, rawSize string) {
+	dir, err := b.openUpload(key, uploadID)
+	if err != nil {
+		http.Error(w, "Upload not found", 404)
+		return
+	}
+
+	number, _ := strconv.Atoi(rawNumber)
+	size, _ := strconv.ParseInt(rawSize, 10, 64)
+	if number < 1 || number > MaxPartCount || r.ContentLength != size {
+		http.Error(w, "Content-Length does not match signed size", 403)
+		return
+	}
+
+	path := partFile(dir, int32(number))
+	etag, err := writeFile(path, http.MaxBytesReader(w, r.Body, size))
+	if err != nil {
+		http.Error(w, "Upload failed", 500)
+		return
+	}
+	if err := os.WriteFile(path+".etag", []byte(etag), 0o644); err != nil {
+		http.Error(w, "Upload failed", 500)
+		return
+	}
+
+	// S3 takes the object's Content-Type at create time; we grab it from the first part
+	if ct := r.Header.Get("Content-Type"); ct != "" && number == 1 {
+		os.WriteFile(filepath.Join(dir, "content-type"), []byte(ct), 0o644)
+	}
+
+	w.Header().Set("ETag", "\""+etag+"\"")
+	w.WriteHeader(http.StatusOK)
+}
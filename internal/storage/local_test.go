@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackend is a LocalBackend in a temp dir, served like main.go mounts it
+func testBackend(t *testing.T) *LocalBackend {
+	t.Helper()
+	b := &LocalBackend{Root: t.TempDir(), secret: []byte("test secret")}
+	mux := http.NewServeMux()
+	mux.Handle(LocalRoute, b)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	b.BaseURL = srv.URL
+	return b
+}
+
+// do sends a request (with body for PUTs) and returns the status, response body and ETag
+func do(t *testing.T, method string, rawURL string, body string) (int, string, string) {
+	t.Helper()
+	var rd io.Reader
+	if method == http.MethodPut {
+		rd = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(data), res.Header.Get("ETag")
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLocalPutAndGet(t *testing.T) {
+	b := testBackend(t)
+
+	putURL, err := b.GeneratePutURL("uploads/a", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, etag := do(t, http.MethodPut, putURL, "hello")
+	if code != 200 || etag != `"`+md5Hex("hello")+`"` {
+		t.Fatalf("PUT: %d etag %s", code, etag)
+	}
+
+	info, err := b.HeadObject("uploads/a")
+	if err != nil || info.Size != 5 || info.ContentType != "text/plain" || info.ETag != md5Hex("hello") {
+		t.Fatalf("HeadObject = %+v, %v", info, err)
+	}
+
+	getURL, _ := b.GenerateGetURL("uploads/a", "greeting.txt")
+	res, err := http.Get(getURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != "hello" || !strings.Contains(res.Header.Get("Content-Disposition"), "greeting.txt") {
+		t.Errorf("GET: %d %q %q", res.StatusCode, body, res.Header.Get("Content-Disposition"))
+	}
+
+	if _, err := b.HeadObject("uploads/missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("HeadObject on a missing key: %v, want ErrNotFound", err)
+	}
+	if _, err := b.GeneratePutURL("../escape", 5); err == nil {
+		t.Error("signed a key outside the root")
+	}
+}
+
+func TestLocalSignedURLs(t *testing.T) {
+	b := testBackend(t)
+	putURL, _ := b.GeneratePutURL("uploads/a", 5)
+	getURL, _ := b.GenerateGetURL("uploads/a", "a.txt")
+
+	// with rewrites one query parameter (or the path) of a signed URL
+	with := func(raw string, change func(u *url.URL, q url.Values)) string {
+		u, _ := url.Parse(raw)
+		q := u.Query()
+		change(u, q)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	expired := time.Now().Add(-time.Minute).Unix()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+	}{
+		{"tampered signature", http.MethodPut, with(putURL, func(u *url.URL, q url.Values) { q.Set("sig", strings.Repeat("0", 64)) }), "hello"},
+		{"bigger size than signed", http.MethodPut, with(putURL, func(u *url.URL, q url.Values) { q.Set("size", "6") }), "hello!"},
+		{"another key", http.MethodPut, with(putURL, func(u *url.URL, q url.Values) { u.Path = LocalRoute + "uploads/b" }), "hello"},
+		{"later expiry than signed", http.MethodPut, with(putURL, func(u *url.URL, q url.Values) {
+			q.Set("exp", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		}), "hello"},
+		{"expired, correctly signed", http.MethodPut, with(putURL, func(u *url.URL, q url.Values) {
+			q.Set("exp", strconv.FormatInt(expired, 10))
+			q.Set("sig", b.sign(http.MethodPut, "uploads/a", expired, "5"))
+		}), "hello"},
+		{"download URL used to upload", http.MethodPut, with(getURL, func(u *url.URL, q url.Values) {}), "hello"},
+		{"other download name", http.MethodGet, with(getURL, func(u *url.URL, q url.Values) { q.Set("name", "b.txt") }), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body, _ := do(t, tt.method, tt.url, tt.body); code != http.StatusForbidden {
+				t.Errorf("got %d %q, want 403", code, body)
+			}
+		})
+	}
+	if _, err := b.HeadObject("uploads/b"); !errors.Is(err, ErrNotFound) {
+		t.Error("a rejected upload was stored")
+	}
+}
+
+func TestLocalUploadSize(t *testing.T) {
+	b := testBackend(t)
+	putURL, _ := b.GeneratePutURL("uploads/a", 5)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"too big", "hello world", http.StatusForbidden},
+		{"too small", "hi", http.StatusForbidden},
+		{"empty", "", http.StatusForbidden},
+		{"exact", "hello", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body, _ := do(t, http.MethodPut, putURL, tt.body); code != tt.want {
+				t.Errorf("got %d %q, want %d", code, body, tt.want)
+			}
+		})
+	}
+	if info, err := b.HeadObject("uploads/a"); err != nil || info.Size != 5 {
+		t.Errorf("stored %+v, %v; want only the exact upload", info, err)
+	}
+}
+
+func TestLocalMultipart(t *testing.T) {
+	b := testBackend(t)
+	key := "uploads/big"
+
+	uploadID, err := b.CreateMultipartUpload(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{"abc", "de"}
+	var parts []CompletedPart
+	// Out of order on purpose: the object is assembled by part number
+	for i := len(chunks) - 1; i >= 0; i-- {
+		partURL, err := b.GeneratePartURL(key, uploadID, int32(i+1), int64(len(chunks[i])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _, _ := do(t, http.MethodPut, partURL, chunks[i]+"!"); code != http.StatusForbidden {
+			t.Errorf("part %d with the wrong size: %d, want 403", i+1, code)
+		}
+		code, _, etag := do(t, http.MethodPut, partURL, chunks[i])
+		if code != 200 {
+			t.Fatalf("part %d: %d", i+1, code)
+		}
+		parts = append([]CompletedPart{{Number: int32(i + 1), ETag: etag}}, parts...)
+	}
+
+	uploaded, err := b.ListParts(key, uploadID)
+	if err != nil || len(uploaded) != 2 || uploaded[0].Number != 1 || uploaded[1].Size != 2 {
+		t.Fatalf("ListParts = %+v, %v", uploaded, err)
+	}
+	if _, err := b.ListParts("uploads/other", uploadID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ListParts under another key: %v, want ErrNotFound", err)
+	}
+
+	bad := []CompletedPart{parts[0], {Number: 2, ETag: `"` + md5Hex("xx") + `"`}}
+	if err := b.CompleteMultipartUpload(key, uploadID, bad); err == nil {
+		t.Error("completed with a wrong part ETag")
+	}
+	if err := b.CompleteMultipartUpload(key, uploadID, append(parts, CompletedPart{Number: 3, ETag: "x"})); err == nil {
+		t.Error("completed with a part that was never uploaded")
+	}
+	if err := b.CompleteMultipartUpload(key, uploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := b.GetObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(data) != "abcde" {
+		t.Errorf("assembled %q, want %q", data, "abcde")
+	}
+	if _, err := b.ListParts(key, uploadID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ListParts after completing: %v, want ErrNotFound", err)
+	}
+
+	aborted, _ := b.CreateMultipartUpload("uploads/aborted")
+	if err := b.AbortMultipartUpload("uploads/aborted", aborted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GeneratePartURL("uploads/aborted", aborted, 1, 5); !errors.Is(err, ErrNotFound) {
+		t.Errorf("part URL after abort: %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalListObjects(t *testing.T) {
+	b := testBackend(t)
+
+	total := localListPageSize + 5
+	for i := 0; i < total; i++ {
+		if _, err := b.writeObject(fmt.Sprintf("uploads/%05d", i), strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.writeObject("other/file", strings.NewReader("x"))
+	// Neither of these is an object: a half-written upload and the metadata dir
+	os.WriteFile(filepath.Join(b.Root, "uploads", ".upload-123"), []byte("x"), 0o644)
+	b.writeMeta("uploads/00000", localMeta{ContentType: "text/plain"})
+
+	var keys []string
+	token := ""
+	pages := 0
+	for {
+		page, err := b.ListObjects("uploads/", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		if len(page.Objects) > localListPageSize {
+			t.Fatalf("page of %d objects", len(page.Objects))
+		}
+		for _, o := range page.Objects {
+			keys = append(keys, o.Key)
+		}
+		if page.NextToken == "" {
+			break
+		}
+		token = page.NextToken
+	}
+
+	if pages != 2 || len(keys) != total {
+		t.Fatalf("%d pages, %d keys; want 2 pages, %d keys", pages, len(keys), total)
+	}
+	for i, k := range keys {
+		if want := fmt.Sprintf("uploads/%05d", i); k != want {
+			t.Fatalf("key %d = %q, want %q (in order, no duplicates)", i, k, want)
+		}
+	}
+}
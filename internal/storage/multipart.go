@@ -0,0 +1,62 @@
+package storage
+
+// --- MULTIPART LIMITS (S3 rules, R2 & MinIO follow them too) ---
+const (
+	MB = 1024 * 1024
+	GB = 1024 * MB
+
+	MaxSinglePutSize = 5 * GB        // Anything bigger must go multipart
+	MaxObjectSize    = 5 * 1024 * GB // 5 TB
+	MinPartSize      = 5 * MB        // Every part except the last
+	MaxPartSize      = 5 * GB
+	MaxPartCount     = 10000
+
+	defaultPartSize = 64 * MB
+)
+
+// Part is one chunk the client has to upload
+type Part struct {
+	Number int32 // 1-based, like S3
+	Size   int64
+}
+
+// CompletedPart is what the client reports back after uploading a part
+type CompletedPart struct {
+	Number int32
+	ETag   string
+}
+
+// UploadedPart is a part the store already has
+type UploadedPart struct {
+	Number int32
+	Size   int64
+	ETag   string
+}
+
+// PartSize picks a chunk size for an object of totalSize bytes.
+// 64 MB by default, growing when needed to stay under MaxPartCount parts.
+func PartSize(totalSize int64) int64 {
+	size := int64(defaultPartSize)
+	for (totalSize+size-1)/size > MaxPartCount {
+		size *= 2
+	}
+	if size > MaxPartSize {
+		size = MaxPartSize
+	}
+	return size
+}
+
+// PlanParts splits totalSize into numbered parts of partSize (last one shorter)
+func PlanParts(totalSize int64, partSize int64) []Part {
+	var parts []Part
+	var offset int64
+	for n := int32(1); offset < totalSize; n++ {
+		size := partSize
+		if totalSize-offset < size {
+			size = totalSize - offset
+		}
+		parts = append(parts, Part{Number: n, Size: size})
+		offset += size
+	}
+	return parts
+}
@@ -2,10 +2,13 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -13,16 +16,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-var (
+// S3Backend talks to AWS S3 (or R2 / MinIO)
+type S3Backend struct {
 	Client        *s3.Client
 	PresignClient *s3.PresignClient
 	BucketName    string
-)
+}
 
 // --- CONNECT ---
-func Connect() {
-	BucketName = os.Getenv("S3_BUCKET_NAME")
-	if BucketName == "" {
+func connectS3() *S3Backend {
+	bucketName := os.Getenv("S3_BUCKET_NAME")
+	if bucketName == "" {
 		log.Fatal("❌ S3_BUCKET_NAME is not set in .env")
 	}
 
@@ -34,21 +38,26 @@ func Connect() {
 		log.Fatalf("❌ Unable to load SDK config, %v", err)
 	}
 
-	Client = s3.NewFromConfig(cfg)
-	PresignClient = s3.NewPresignClient(Client)
+	client := s3.NewFromConfig(cfg)
 	log.Println("✅ Connected to AWS S3")
+
+	return &S3Backend{
+		Client:        client,
+		PresignClient: s3.NewPresignClient(client),
+		BucketName:    bucketName,
+	}
 }
 
 // --- GENERATE UPLOAD URL (WITH HARD LIMIT) ---
 // sizeLimit: bytes (e.g., 1024*1024*1024 for 1GB)
-func GeneratePutURL(key string, sizeLimit int64) (string, error) {
-	req, err := PresignClient.PresignPutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:        aws.String(BucketName),
-		Key:           aws.String(key),
+func (b *S3Backend) GeneratePutURL(key string, sizeLimit int64) (string, error) {
+	req, err := b.PresignClient.PresignPutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(b.BucketName),
+		Key:    aws.String(key),
 		// 🔒 SECURITY: This locks the upload to this exact size.
 		// If user tries to upload more, S3 rejects the signature or cuts the stream.
-		ContentLength: aws.Int64(sizeLimit), 
-	}, s3.WithPresignExpires(15*time.Minute))
+		ContentLength: aws.Int64(sizeLimit),
+	}, s3.WithPresignExpires(URLExpiry))
 
 	if err != nil {
 		return "", err
@@ -57,15 +66,15 @@ func GeneratePutURL(key string, sizeLimit int64) (string, error) {
 }
 
 // --- GENERATE DOWNLOAD URL (WITH PRETTY NAME) ---
-func GenerateGetURL(key string, downloadName string) (string, error) {
+func (b *S3Backend) GenerateGetURL(key string, downloadName string) (string, error) {
 	// Forces browser to save as "vacation.jpg" instead of "uuid-hash..."
 	disposition := fmt.Sprintf("attachment; filename=\"%s\"", downloadName)
 
-	req, err := PresignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket:                     aws.String(BucketName),
+	req, err := b.PresignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket:                     aws.String(b.BucketName),
 		Key:                        aws.String(key),
 		ResponseContentDisposition: aws.String(disposition),
-	}, s3.WithPresignExpires(15*time.Minute))
+	}, s3.WithPresignExpires(URLExpiry))
 
 	if err != nil {
 		return "", err
@@ -74,30 +83,286 @@ func GenerateGetURL(key string, downloadName string) (string, error) {
 }
 
 // --- DELETE ---
-func DeleteFile(key string) error {
-	_, err := Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(BucketName),
+func (b *S3Backend) DeleteFile(key string) error {
+	_, err := b.Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.BucketName),
 		Key:    aws.String(key),
 	})
 	return err
 }
 
 // --- BATCH DELETE ---
-func DeleteMultiple(keys []string) error {
-	if len(keys) == 0 { return nil }
+// Chunked into 1000-key DeleteObjects calls, see deleteInBatches.
+func (b *S3Backend) DeleteMultiple(keys []string) (*DeleteReport, error) {
+	return deleteInBatches(keys, b.deleteBatch)
+}
 
+// deleteBatch is a single DeleteObjects call (max 1000 keys)
+func (b *S3Backend) deleteBatch(keys []string) map[string]error {
 	// S3 requires a specific struct for batch deletes
 	var objectIds []types.ObjectIdentifier
 	for _, k := range keys {
 		objectIds = append(objectIds, types.ObjectIdentifier{Key: aws.String(k)})
 	}
 
-	// We can delete max 1000 at a time. For this demo, assuming <1000.
-	// In prod, you would chunk this loop.
-	_, err := Client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
-		Bucket: aws.String(BucketName),
-		Delete: &types.Delete{Objects: objectIds},
+	// Quiet: only the failures come back
+	out, err := b.Client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+		Bucket: aws.String(b.BucketName),
+		Delete: &types.Delete{Objects: objectIds, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return errAll(keys, err)
+	}
+
+	// The call "succeeding" doesn't mean every key did
+	failed := make(map[string]error)
+	for _, e := range out.Errors {
+		failed[aws.ToString(e.Key)] = fmt.Errorf("%s: %s", aws.ToString(e.Code), aws.ToString(e.Message))
+	}
+	return failed
+}
+
+// --- HEAD ---
+func (b *S3Backend) HeadObject(key string) (*ObjectInfo, error) {
+	out, err := b.Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        aws.ToInt64(out.ContentLength),
+		ETag:        strings.Trim(aws.ToString(out.ETag), "\""),
+		ContentType: aws.ToString(out.ContentType),
+	}
+	if out.LastModified != nil {
+		info.LastModified = *out.LastModified
+	}
+	return info, nil
+}
+
+// --- GET (STREAM) ---
+func (b *S3Backend) GetObject(key string) (io.ReadCloser, error) {
+	out, err := b.Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(b.BucketName),
+		Key:    aws.String(key),
 	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return out.Body, nil
+}
+
+// --- LIST (ONE PAGE) ---
+func (b *S3Backend) ListObjects(prefix string, token string) (*ObjectPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.BucketName),
+		Prefix: aws.String(prefix),
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
 
+	out, err := b.Client.ListObjectsV2(context.TODO(), input)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ObjectPage{}
+	for _, obj := range out.Contents {
+		info := ObjectInfo{
+			Key:  aws.ToString(obj.Key),
+			Size: aws.ToInt64(obj.Size),
+			ETag: strings.Trim(aws.ToString(obj.ETag), "\""),
+		}
+		if obj.LastModified != nil {
+			info.LastModified = *obj.LastModified
+		}
+		page.Objects = append(page.Objects, info)
+	}
+	if aws.ToBool(out.IsTruncated) {
+		page.NextToken = aws.ToString(out.NextContinuationToken)
+	}
+	return page, nil
+}
+
+// --- SERVER-SIDE COPY ---
+// Bytes never leave S3. CopyObject tops out at 5GB, bigger objects
+// are copied part by part with UploadPartCopy.
+func (b *S3Backend) CopyObject(srcKey string, dstKey string) error {
+	info, err := b.HeadObject(srcKey)
+	if err != nil {
+		return err
+	}
+	if info.Size > MaxSinglePutSize {
+		return b.copyMultipart(srcKey, dstKey, info)
+	}
+
+	_, err = b.Client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String(b.BucketName),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(b.BucketName + "/" + srcKey),
+	})
 	return err
-}
\ No newline at end of file
+}
+
+// Parts copied at once for a big copy
+const copyConcurrency = 8
+
+func (b *S3Backend) copyMultipart(srcKey string, dstKey string, src *ObjectInfo) error {
+	created, err := b.Client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(b.BucketName),
+		Key:         aws.String(dstKey),
+		ContentType: aws.String(src.ContentType),
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := aws.ToString(created.UploadId)
+
+	partSize := PartSize(src.Size)
+	plan := PlanParts(src.Size, partSize)
+	completed := make([]CompletedPart, len(plan))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, copyConcurrency)
+	)
+	for i, p := range plan {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := int64(p.Number-1) * partSize
+			out, err := b.Client.UploadPartCopy(context.TODO(), &s3.UploadPartCopyInput{
+				Bucket:          aws.String(b.BucketName),
+				Key:             aws.String(dstKey),
+				UploadId:        aws.String(uploadID),
+				PartNumber:      aws.Int32(p.Number),
+				CopySource:      aws.String(b.BucketName + "/" + srcKey),
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, start+p.Size-1)),
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			completed[i] = CompletedPart{Number: p.Number, ETag: aws.ToString(out.CopyPartResult.ETag)}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		b.AbortMultipartUpload(dstKey, uploadID)
+		return firstErr
+	}
+	return b.CompleteMultipartUpload(dstKey, uploadID, completed)
+}
+
+// --- MULTIPART ---
+
+func (b *S3Backend) CreateMultipartUpload(key string) (string, error) {
+	out, err := b.Client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(b.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (b *S3Backend) GeneratePartURL(key string, uploadID string, partNumber int32, size int64) (string, error) {
+	req, err := b.PresignClient.PresignUploadPart(context.TODO(), &s3.UploadPartInput{
+		Bucket:     aws.String(b.BucketName),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int32(partNumber),
+		// 🔒 Same hard limit as GeneratePutURL, per part
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(URLExpiry))
+
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (b *S3Backend) CompleteMultipartUpload(key string, uploadID string, parts []CompletedPart) error {
+	var completed []types.CompletedPart
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: aws.Int32(p.Number),
+			ETag:       aws.String(p.ETag),
+		})
+	}
+
+	_, err := b.Client.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (b *S3Backend) AbortMultipartUpload(key string, uploadID string) error {
+	_, err := b.Client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return notFound(err)
+}
+
+func (b *S3Backend) ListParts(key string, uploadID string) ([]UploadedPart, error) {
+	var parts []UploadedPart
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(b.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+
+	// S3 returns at most 1000 parts per call
+	for {
+		out, err := b.Client.ListParts(context.TODO(), input)
+		if err != nil {
+			return nil, notFound(err)
+		}
+
+		for _, p := range out.Parts {
+			parts = append(parts, UploadedPart{
+				Number: aws.ToInt32(p.PartNumber),
+				Size:   aws.ToInt64(p.Size),
+				ETag:   strings.Trim(aws.ToString(p.ETag), "\""),
+			})
+		}
+
+		if !aws.ToBool(out.IsTruncated) {
+			return parts, nil
+		}
+		input.PartNumberMarker = out.NextPartNumberMarker
+	}
+}
+
+// notFound maps the SDK's "missing" errors onto ErrNotFound
+func notFound(err error) error {
+	var nf *types.NotFound
+	var nsk *types.NoSuchKey
+	var nsu *types.NoSuchUpload
+	if errors.As(err, &nf) || errors.As(err, &nsk) || errors.As(err, &nsu) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,15 +23,19 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"s3-drive/internal/database"
+	"s3-drive/internal/jwtkeys"
 	"s3-drive/internal/storage"
 	"s3-drive/internal/middleware"
+	"s3-drive/internal/sso"
 )
 
 //go:embed frontend/dist/*
 //var frontend embed.FS
 var frontendContent embed.FS
 
-var jwtSecret = []byte("REPLACE_THIS_WITH_RANDOM_STRING") // Use ENV in prod
+const accessTokenTTL = 15 * time.Minute // Renewed with the session's refresh token
+
+const guestUploadLimit = 1 * storage.GB // Max single file size for Guests
 
 
 func enableCORS(next http.Handler) http.Handler {
@@ -47,6 +56,7 @@ func enableCORS(next http.Handler) http.Handler {
 
         w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
         w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+        w.Header().Set("Access-Control-Expose-Headers", "ETag") // multipart clients read part ETags
 
         // Handle Preflight
         if r.Method == "OPTIONS" {
@@ -66,9 +76,15 @@ func main() {
 
 	// 1. Initialize Systems
 	database.Connect() // Connects to SQLite or Postgres
-	storage.Connect()  // Connects to S3
+	storage.Connect()  // Connects to S3 (or local disk, see STORAGE_BACKEND)
+	sso.Connect()      // OIDC single sign-on, if OIDC_ISSUER_URL is set
+	jwtkeys.Load()     // JWT signing keys (JWT_SECRET or JWT_PRIVATE_KEY_FILE)
+	middleware.LoadTrustedProxies() // Whose X-Forwarded-For to believe (TRUSTED_PROXIES)
 
 	go database.StartCleanupTask()
+	go database.StartReconcileTask()
+	go database.StartDeletionWorker()
+	go database.StartTrashPurgeTask()
 	go middleware.StartCleanup()
 
 	// 2. Create Default Admin (if none exists)
@@ -78,17 +94,72 @@ func main() {
 	mux := http.NewServeMux()
 
 	// --- PUBLIC AUTH ---
-	mux.HandleFunc("/api/login", handleLogin)             // For Admin
+	mux.HandleFunc("/api/login", middleware.RateLimit(handleLogin)) // Admins and users; wrong passwords also count per account
 	mux.HandleFunc("/api/guest-login", middleware.RateLimit(handleGuestLogin)) // For Guests
-	mux.HandleFunc("/api/admin/update-password", authMiddleware(handleUpdateAdminPassword))
+	mux.HandleFunc("/api/register", middleware.RateLimit(handleRegister)) // self-registration, only while an admin allows it
+	mux.HandleFunc("/api/oidc/login", middleware.RateLimit(handleOIDCLogin))       // redirects to the SSO provider
+	mux.HandleFunc("/api/oidc/callback", middleware.RateLimit(handleOIDCCallback)) // provider redirects back here
+	mux.HandleFunc("/.well-known/jwks.json", handleJWKS)                          // public keys, for services verifying our tokens
+	mux.HandleFunc("/api/admin/update-password", authMiddleware(handleUpdatePassword)) // kept for old clients
+	mux.HandleFunc("/api/account/password", authMiddleware(handleUpdatePassword)) // also logs out your other sessions
+	mux.HandleFunc("/api/login/2fa", middleware.RateLimit(handleLogin2FA))         // second login step: {challenge, code}
+	mux.HandleFunc("/api/2fa", authMiddleware(handle2FA))                          // GET = status, POST = enroll (secret + otpauth URI)
+	mux.HandleFunc("/api/2fa/activate", authMiddleware(handle2FAActivate))         // first code -> 2FA on + recovery codes
+	mux.HandleFunc("/api/2fa/disable", authMiddleware(handle2FADisable))           // password + code
+	mux.HandleFunc("/api/2fa/recovery-codes", authMiddleware(handle2FARecoveryCodes)) // new set of recovery codes
+	mux.HandleFunc("/api/refresh", middleware.RateLimit(handleRefresh))            // refresh token -> new access + refresh token
+	mux.HandleFunc("/api/logout", authMiddleware(handleLogout))                    // ends this session
+	mux.HandleFunc("/api/logout-all", authMiddleware(handleLogoutAll))             // ends every session of the account
+	mux.HandleFunc("/api/sessions", authMiddleware(handleSessions))                // your active sessions (IP, user agent, last use)
+	mux.HandleFunc("/api/sessions/revoke", authMiddleware(handleSessionRevoke))
+	mux.HandleFunc("/api/tokens", authMiddleware(handleAPITokens))             // GET = your API tokens, POST = new one
+	mux.HandleFunc("/api/tokens/revoke", authMiddleware(handleAPITokenRevoke))
+	mux.HandleFunc("/api/admin/users", authMiddleware(handleAdminUsers))                  // GET = list, POST = create
+	mux.HandleFunc("/api/admin/users/update", authMiddleware(handleAdminUserUpdate))      // role / disabled
+	mux.HandleFunc("/api/admin/users/delete", authMiddleware(handleAdminUserDelete))      // account + everything it owns
+	mux.HandleFunc("/api/admin/users/password", authMiddleware(handleAdminResetPassword)) // reset someone's password
+	mux.HandleFunc("/api/admin/users/2fa-reset", authMiddleware(handleAdminReset2FA))     // turn someone's 2FA off
+	mux.HandleFunc("/api/admin/settings", authMiddleware(handleAdminSettings))            // GET / POST {allowRegistration}
+	mux.HandleFunc("/api/admin/groups", authMiddleware(handleAdminGroups))                        // GET = list, POST = create {name}
+	mux.HandleFunc("/api/admin/groups/delete", authMiddleware(handleAdminGroupDelete))            // group + its grants
+	mux.HandleFunc("/api/admin/groups/members", authMiddleware(handleAdminGroupMembers))          // GET ?id= = list, POST = add {groupId, username}
+	mux.HandleFunc("/api/admin/groups/members/remove", authMiddleware(handleAdminGroupMemberRemove))
+	mux.HandleFunc("/api/admin/reconcile", authMiddleware(handleReconcile)) // bucket vs DB diff (GET = dry run, POST ?dryRun=false deletes orphans)
 
 	// --- PROTECTED ROUTES (Middleware Required) ---
     mux.HandleFunc("/api/upload-init", middleware.RateLimit(authMiddleware(handleUploadInit)))
 	mux.HandleFunc("/api/upload-finalize", middleware.RateLimit(authMiddleware(handleUploadFinalize)))
+	mux.HandleFunc("/api/multipart/init", middleware.RateLimit(authMiddleware(handleMultipartInit)))         // big files: presigned URL per part
+	mux.HandleFunc("/api/multipart/complete", middleware.RateLimit(authMiddleware(handleMultipartComplete))) // stitches the parts (needs their ETags)
+	mux.HandleFunc("/api/multipart/abort", middleware.RateLimit(authMiddleware(handleMultipartAbort)))
+	mux.HandleFunc("/api/multipart/status", middleware.RateLimit(authMiddleware(handleMultipartStatus)))   // resume: progress + URLs for missing parts
+	mux.HandleFunc("/api/multipart/pending", middleware.RateLimit(authMiddleware(handleMultipartPending))) // unfinished uploads to offer resuming
 	mux.HandleFunc("/api/files", middleware.RateLimit(authMiddleware(handleListFiles)))
+	mux.HandleFunc("/api/usage", middleware.RateLimit(authMiddleware(handleUsage))) // storage used vs. quota
 	mux.HandleFunc("/api/download", middleware.RateLimit(authMiddleware(handleDownload)))
 	mux.HandleFunc("/api/folders", middleware.RateLimit(authMiddleware(handleCreateFolder)))
 	mux.HandleFunc("/api/delete", middleware.RateLimit(authMiddleware(handleDelete)))
+	mux.HandleFunc("/api/rename", middleware.RateLimit(authMiddleware(handleRename)))
+	mux.HandleFunc("/api/move", middleware.RateLimit(authMiddleware(handleMove))) // file or folder (with contents) into another folder
+	mux.HandleFunc("/api/copy", middleware.RateLimit(authMiddleware(handleCopy))) // server-side copy, bytes stay in the bucket
+	mux.HandleFunc("/api/versions", middleware.RateLimit(authMiddleware(handleVersions)))                 // version history of a file (current first)
+	mux.HandleFunc("/api/versions/download", middleware.RateLimit(authMiddleware(handleVersionDownload))) // presigned URL for an old version
+	mux.HandleFunc("/api/versions/restore", middleware.RateLimit(authMiddleware(handleVersionRestore)))   // makes an old version current again
+	mux.HandleFunc("/api/acl", middleware.RateLimit(authMiddleware(handleACL)))                   // GET = grants on ?id=, POST = grant {itemId, username, level}
+	mux.HandleFunc("/api/acl/revoke", middleware.RateLimit(authMiddleware(handleACLRevoke)))
+	mux.HandleFunc("/api/groups", middleware.RateLimit(authMiddleware(handleGroups)))             // group names, to share with
+	mux.HandleFunc("/api/shared-with-me", middleware.RateLimit(authMiddleware(handleSharedWithMe))) // items other users granted you
+	mux.HandleFunc("/api/shares", middleware.RateLimit(authMiddleware(handleShares)))             // GET = your links (?fileId=), POST = new link
+	mux.HandleFunc("/api/shares/revoke", middleware.RateLimit(authMiddleware(handleShareRevoke)))
+	mux.HandleFunc("/api/public/share", middleware.RateLimit(handlePublicShare)) // NO AUTH: token (+ access) -> download URL / folder listing
+	mux.HandleFunc("/api/public/share/unlock", middleware.RateLimit(handlePublicShareUnlock)) // NO AUTH: token + password -> access token
+	mux.HandleFunc("/api/public/share/list", middleware.RateLimit(handlePublicShareList)) // NO AUTH: subfolder of a shared folder
+	mux.HandleFunc("/api/public/share/zip", middleware.RateLimit(handlePublicShareZip))   // NO AUTH: shared folder as one zip
+	mux.HandleFunc("/api/file-requests", middleware.RateLimit(authMiddleware(handleFileRequests)))             // GET = your drop links, POST = new one
+	mux.HandleFunc("/api/file-requests/revoke", middleware.RateLimit(authMiddleware(handleFileRequestRevoke)))
+	mux.HandleFunc("/api/public/drop", middleware.RateLimit(handlePublicDrop))                  // NO AUTH: what a drop link accepts
+	mux.HandleFunc("/api/public/drop/init", middleware.RateLimit(handlePublicDropInit))         // NO AUTH: presigned PUT into the drop folder
+	mux.HandleFunc("/api/public/drop/finalize", middleware.RateLimit(handlePublicDropFinalize))
 
 	mux.HandleFunc("/api/search", middleware.RateLimit(authMiddleware(handleSearch))) //searches within user's accessible files
 	mux.HandleFunc("/api/recents", middleware.RateLimit(authMiddleware(handleRecents))) // shows recently accessed files (by last modified or accessed timestamp)
@@ -97,9 +168,16 @@ func main() {
 	mux.HandleFunc("/api/star-toggle", middleware.RateLimit(authMiddleware(handleStarToggle))) // toggles star state for a file (star if unstarred, unstar if starred)
 
 	mux.HandleFunc("/api/trash", middleware.RateLimit(authMiddleware(handleTrashList))) // lists all files in the user's trash (soft-deleted items)
+	mux.HandleFunc("/api/trash/empty", middleware.RateLimit(authMiddleware(handleEmptyTrash))) // permanently deletes everything in the user's trash
 	mux.HandleFunc("/api/soft-delete", middleware.RateLimit(authMiddleware(handleSoftDelete))) // moves a file to trash (soft delete, can be restored)
 	mux.HandleFunc("/api/restore", middleware.RateLimit(authMiddleware(handleRestore))) //
 
+	// --- LOCAL STORAGE (only when STORAGE_BACKEND=local) ---
+	// Signed URLs are the auth here, same as a presigned S3 URL.
+	if h, ok := storage.Store.(http.Handler); ok {
+		mux.Handle(storage.LocalRoute, h)
+	}
+
 	// --- STATIC FILES ---
 	//distFS, _ := fs.Sub(frontend, "frontend/dist")
 	//fileServer := http.FileServer(http.FS(distFS))
@@ -187,10 +265,11 @@ func handleStarred(w http.ResponseWriter, r *http.Request) {
 
 func handleStarToggle(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 	var req struct { ID uint `json:"id"` }
 	json.NewDecoder(r.Body).Decode(&req)
 
-	newState, err := database.ToggleStar(req.ID, userID)
+	newState, err := database.ToggleStar(req.ID, userID, role)
 	if err != nil { http.Error(w, err.Error(), 400); return }
 
 	json.NewEncoder(w).Encode(map[string]bool{"is_starred": newState})
@@ -198,35 +277,54 @@ func handleStarToggle(w http.ResponseWriter, r *http.Request) {
 
 func handleTrashList(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(uint)
-	files, err := database.GetTrash(1, userID)
+	role := r.Context().Value("role").(string)
+	files, err := database.GetTrash(1, userID, role)
 	if err != nil { http.Error(w, err.Error(), 500); return }
 	json.NewEncoder(w).Encode(files)
 }
 
+func handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	count, err := database.EmptyTrash(userID, role)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "emptied",
+		"count":  fmt.Sprintf("%d items removed", count),
+	})
+}
+
 func handleSoftDelete(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 	var req struct { ID uint `json:"id"` }
 	json.NewDecoder(r.Body).Decode(&req)
 
-	// Note: You might want a recursive soft delete for folders here later
-	err := database.SoftDelete(req.ID, userID)
+	// Folders take their whole subtree with them
+	item, err := database.SoftDelete(req.ID, userID, role)
 	if err != nil { http.Error(w, err.Error(), 400); return }
 	
 	// Invalidate cache since item moved
-	database.InvalidateCache(nil, userID) // Lazy invalidation (root)
+	database.InvalidateCache(item.ParentID, userID)
 
 	json.NewEncoder(w).Encode(map[string]string{"status": "trashed"})
 }
 
 func handleRestore(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 	var req struct { ID uint `json:"id"` }
 	json.NewDecoder(r.Body).Decode(&req)
 
-	err := database.RestoreFromTrash(req.ID, userID)
+	item, err := database.RestoreFromTrash(req.ID, userID, role)
 	if err != nil { http.Error(w, err.Error(), 400); return }
 	
-	database.InvalidateCache(nil, userID)
+	// ParentID is nil if it had to go back to root
+	database.InvalidateCache(item.ParentID, userID)
 
 	json.NewEncoder(w).Encode(map[string]string{"status": "restored"})
 }
@@ -245,306 +343,1850 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 	var id uint
 	fmt.Sscanf(rawID, "%d", &id)
 
-	// 1. Calculate what needs to be deleted
-	candidates, err := database.GetDeletionCandidates(id, userID, role)
+	// Rows now, S3 objects via the deletion queue, cache cleared
+	candidates, err := database.HardDelete(id, userID, role)
 	if err != nil {
 		http.Error(w, err.Error(), 403)
 		return
 	}
 
-	// 2. Delete from S3 (Batch)
-	if len(candidates.S3Keys) > 0 {
-		// Ignore S3 errors (orphaned files are better than DB inconsistency)
-		_ = storage.DeleteMultiple(candidates.S3Keys)
-	}
-
-	// 3. Delete from DB
-	database.BatchDelete(candidates.DBIds)
-
-	// 4. FIX: Invalidate Cache!
-	// This forces the file list to refresh on the next request
-	database.InvalidateCache(candidates.RootParentID, userID)
-
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "deleted",
 		"count":  fmt.Sprintf("%d items removed", len(candidates.DBIds)),
 	})
 }
-func handleCreateFolder(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+func handleRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
 
-    userID := r.Context().Value("userID").(uint)
-    role := r.Context().Value("role").(string) // <--- GET ROLE
-    
-    var req struct {
-        Name     string `json:"name"`
-        ParentID *uint  `json:"parentId"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", 400); return
-    }
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-    // Determine Visibility
-    // Admin folders = Private (unless specified otherwise, but default private)
-    // Guest folders = Public (Always, so they can see them)
-    isPublic := (role == "guest")
+	var req struct {
+		ID   uint   `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
 
-    // Pass isPublic to the DB function
-    folder, err := database.CreateFolder(req.Name, req.ParentID, userID, isPublic)
-    if err != nil {
-        http.Error(w, err.Error(), 400); return
-    }
+	item, err := database.RenameItem(req.ID, req.Name, userID, role)
+	if err != nil { http.Error(w, err.Error(), 400); return }
 
-    json.NewEncoder(w).Encode(folder)
+	json.NewEncoder(w).Encode(item)
 }
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	var req struct { Username, Password string }
-	json.NewDecoder(r.Body).Decode(&req)
+func handleMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
 
-	var user database.User
-	if err := database.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
-		http.Error(w, "Invalid credentials", 401); return
-	}
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid credentials", 401); return
+	var req struct {
+		ID       uint  `json:"id"`
+		ParentID *uint `json:"parentId"` // null = root
 	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	item, err := database.MoveItem(req.ID, req.ParentID, userID, role)
+	if err != nil { http.Error(w, err.Error(), 400); return }
 
-	sendToken(w, user.ID, "admin")
+	json.NewEncoder(w).Encode(item)
 }
 
-func handleGuestLogin(w http.ResponseWriter, r *http.Request) {
-	// Simple Guest Login. In future, check IP Limits here.
-	// We use ID=0 to signify Guest
-	sendToken(w, 0, "guest")
+func handleCopy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct {
+		ID       uint  `json:"id"`
+		ParentID *uint `json:"parentId"` // null = root
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	item, err := database.CopyItem(req.ID, req.ParentID, userID, role)
+	if errors.Is(err, database.ErrQuotaExceeded) { http.Error(w, err.Error(), 403); return }
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(item)
 }
 
-func handleUploadInit(w http.ResponseWriter, r *http.Request) {
-	// Extract info from context (set by middleware)
+// --- VERSIONS ---
+
+func handleVersions(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(uint)
 	role := r.Context().Value("role").(string)
 
-	var req struct { Filename string; Size int64; ParentID *uint `json:"parentId"` }
-	json.NewDecoder(r.Body).Decode(&req)
+	var fileID uint
+	fmt.Sscanf(r.URL.Query().Get("id"), "%d", &fileID)
 
-	// 🔒 ENFORCE LIMITS
-	const GB = 1024 * 1024 * 1024
-	var limit int64
-	if role == "guest" {
-		limit = 1 * GB // 1GB for Guests
-		if req.Size > limit {
-			http.Error(w, "Guest limit exceeded (Max 1GB)", 403); return
-		}
-	} else {
-		limit = 5 * GB // 5GB for Admins (S3 single PUT limit)
-	}
+	versions, err := database.ListVersions(fileID, userID, role)
+	if err != nil { http.Error(w, err.Error(), 404); return }
 
-	// Generate UUID Key
-	uniqueKey := fmt.Sprintf("uploads/%s", uuid.New().String())
+	json.NewEncoder(w).Encode(versions)
+}
 
-	// Save to DB (Pending State)
-	isPublic := (role == "guest") // Guests uploads are public by default? Or private? 
-	// Let's say Guest uploads are PUBLIC so they can share them.
-	
-	var userPtr *uint
-	if userID != 0 { userPtr = &userID }
+func handleVersionDownload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-	newFile := database.FileMetadata{
-		Name: req.Filename, S3Key: uniqueKey, Size: req.Size, 
-		UserID: userPtr, IsPublic: isPublic,
-		ParentID: req.ParentID,
-		Status: "pending",
-	}
-	database.DB.Create(&newFile)
-	database.InvalidateCache(req.ParentID, userID)
+	var fileID, versionID uint
+	fmt.Sscanf(r.URL.Query().Get("id"), "%d", &fileID)
+	fmt.Sscanf(r.URL.Query().Get("versionId"), "%d", &versionID)
 
-	// Generate S3 URL with HARD LIMIT
-	url, err := storage.GeneratePutURL(uniqueKey, req.Size) // MUST match exactly
+	file, version, err := database.GetVersion(fileID, versionID, userID, role)
+	if err != nil { http.Error(w, err.Error(), 404); return }
+
+	url, err := storage.Store.GenerateGetURL(version.S3Key, file.Name)
 	if err != nil {
 		http.Error(w, err.Error(), 500); return
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"uploadUrl": url, "fileId": newFile.ID,
-	})
+	json.NewEncoder(w).Encode(map[string]string{"downloadUrl": url})
 }
 
-func handleUploadFinalize(w http.ResponseWriter, r *http.Request) {
-    var req struct { FileID uint `json:"fileId"` }
-    json.NewDecoder(r.Body).Decode(&req)
+func handleVersionRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
 
-    // 1. Get UserID to ensure they own the file (security check)
-    userID := r.Context().Value("userID").(uint)
-    role := r.Context().Value("role").(string)
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-    //var file database.FileMetadata
-    // Admin can finalize anything? Or just their own? Let's stay safe:
-    // User can only finalize their own file.
-    query := database.DB.Model(&database.FileMetadata{}).Where("id = ?", req.FileID)
-    
-    if role != "admin" {
-         // If guest (ID 0) or normal user, verify ownership/public logic
-         if userID == 0 {
-             // Guest: must match public files that are pending? 
-             // Ideally we need a session ID for guests to fully secure this, 
-             // but for now, checking ID exists is okay for Test 2.
-         } else {
-             query = query.Where("user_id = ?", userID)
-         }
-    }
+	var req struct {
+		ID        uint `json:"id"`
+		VersionID uint `json:"versionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
 
-    // 2. Flip the switch
-    result := query.Update("status", "completed")
-    
-    if result.Error != nil || result.RowsAffected == 0 {
-        http.Error(w, "File not found or access denied", 404)
-        return
-    }
+	file, err := database.RestoreVersion(req.ID, req.VersionID, userID, role)
+	if err != nil { http.Error(w, err.Error(), 400); return }
 
-    json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(file)
 }
 
-func handleListFiles(w http.ResponseWriter, r *http.Request) {
-    userID := r.Context().Value("userID").(uint)
-    role := r.Context().Value("role").(string)
-    
-    // Parse Parent ID from Query (e.g., ?parentId=5)
-    // If empty or "null", it means Root.
-    rawParentID := r.URL.Query().Get("parentId")
-    
-    var parentID *uint
-    if rawParentID != "" && rawParentID != "null" {
-        // Convert string to uint... (simplified for brevity)
-        var pID uint
-        fmt.Sscanf(rawParentID, "%d", &pID)
-        parentID = &pID
-    }
+// --- SHARE LINKS ---
 
-    files, err := database.GetFolderContent(parentID, userID, role)
-    if err != nil {
-        http.Error(w, err.Error(), 500); return
-    }
-    
-    json.NewEncoder(w).Encode(files)
-}
+func handleShares(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-func handleDownload(w http.ResponseWriter, r *http.Request) {
-	fileID := r.URL.Query().Get("id")
-	var file database.FileMetadata
-	if err := database.DB.First(&file, fileID).Error; err != nil {
-		http.Error(w, "Not found", 404); return
+	if r.Method == "GET" {
+		var fileID uint
+		fmt.Sscanf(r.URL.Query().Get("fileId"), "%d", &fileID)
+
+		links, err := database.ListShareLinks(fileID, userID, role)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+
+		json.NewEncoder(w).Encode(links)
+		return
 	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
 
-	// Generate URL
-	url, err := storage.GenerateGetURL(file.S3Key, file.Name)
-	if err != nil {
-		http.Error(w, err.Error(), 500); return
+	var req struct {
+		FileID       uint   `json:"fileId"`
+		Password     string `json:"password"`     // optional
+		ExpiresAt    int64  `json:"expiresAt"`    // unix seconds, 0 = never
+		MaxDownloads int    `json:"maxDownloads"` // 0 = unlimited
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"downloadUrl": url})
+	link, err := database.CreateShareLink(req.FileID, userID, role, req.Password, req.ExpiresAt, req.MaxDownloads)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(link)
 }
 
-// --- HELPERS ---
+func handleShareRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
 
-func sendToken(w http.ResponseWriter, id uint, role string) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": id,
-		"role": role,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
-	})
-	tokenString, _ := token.SignedString(jwtSecret)
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.RevokeShareLink(req.ID, userID, role); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
 }
 
-func ensureAdminExists() {
-	var count int64
-	database.DB.Model(&database.User{}).Count(&count)
-	if count == 0 {
-		hash, _ := bcrypt.GenerateFromPassword([]byte("admin123"), 14)
-		database.DB.Create(&database.User{Username: "admin", Password: string(hash)})
-		log.Println("⚠️ Created default user: admin / admin123")
+// --- SHARING BETWEEN USERS (ACLs) ---
+
+func handleACL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	if r.Method == "GET" {
+		var itemID uint
+		fmt.Sscanf(r.URL.Query().Get("id"), "%d", &itemID)
+
+		grants, err := database.ListGrants(itemID, userID, role)
+		if err != nil { http.Error(w, err.Error(), 403); return }
+
+		json.NewEncoder(w).Encode(grants)
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	var req struct {
+		ItemID   uint   `json:"itemId"`
+		Username string `json:"username"` // either a user...
+		Group    string `json:"group"`    // ...or a group
+		Level    string `json:"level"`    // viewer, editor or owner
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
 	}
+
+	subjectType, name := "user", req.Username
+	if req.Group != "" {
+		subjectType, name = "group", req.Group
+	}
+
+	grant, err := database.Grant(req.ItemID, subjectType, name, req.Level, userID, role)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(grant)
 }
 
-// --- MIDDLEWARE ---
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Missing Auth Token", 401); return
-		}
-		
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+func handleACLRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
 
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid Token", 401); return
-		}
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-		claims := token.Claims.(jwt.MapClaims)
-		userID := uint(claims["sub"].(float64))
-		role := claims["role"].(string)
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
 
-		ctx := context.WithValue(r.Context(), "userID", userID)
-		ctx = context.WithValue(ctx, "role", role)
-		next(w, r.WithContext(ctx))
+	if err := database.RevokeGrant(req.ID, userID, role); err != nil {
+		http.Error(w, err.Error(), 403); return
 	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
 }
 
-func handleUpdateAdminPassword(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "POST" {
-        http.Error(w, "POST only", 405)
-        return
-    }
+func handleSharedWithMe(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
 
-    userID := r.Context().Value("userID").(uint)
-    role := r.Context().Value("role").(string)
+	files, err := database.SharedWithMe(userID, role)
+	if err != nil { http.Error(w, err.Error(), 500); return }
 
-    // Only allow admins to use this specific route
-    if role != "admin" {
-        http.Error(w, "Unauthorized: Admin access required", 403)
-        return
-    }
+	json.NewEncoder(w).Encode(files)
+}
 
-    var req struct {
-        OldPassword string `json:"oldPassword"`
-        NewPassword string `json:"newPassword"`
-    }
+// Public share endpoints take the token (and access token) from the JSON body on
+// POST, or from the query string on GET so links and zips open in a browser.
+// Passwords never go in a URL: /api/public/share/unlock trades one for "access".
+type shareRequest struct {
+	Token    string `json:"token"`
+	Access   string `json:"access"`   // from /api/public/share/unlock, password-protected links only
+	FileID   uint   `json:"fileId"`   // folder links: the file to download
+	ParentID *uint  `json:"parentId"` // folder links: the subfolder to list / zip
+}
 
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", 400)
-        return
-    }
+const shareAccessTTL = time.Hour
 
-    // 1. Fetch the user from the DB
-    var user database.User
-    if err := database.DB.First(&user, userID).Error; err != nil {
-        http.Error(w, "User not found", 404)
-        return
-    }
+func readShareRequest(r *http.Request) shareRequest {
+	var req shareRequest
+	if r.Method == "POST" {
+		json.NewDecoder(r.Body).Decode(&req)
+		return req
+	}
 
-    // 2. Verify the OLD password
-    err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.OldPassword))
-    if err != nil {
-        http.Error(w, "Current password incorrect", 401)
-        return
-    }
+	q := r.URL.Query()
+	req.Token = q.Get("token")
+	req.Access = q.Get("access")
+	fmt.Sscanf(q.Get("fileId"), "%d", &req.FileID)
+	if raw := q.Get("parentId"); raw != "" && raw != "null" {
+		var pID uint
+		fmt.Sscanf(raw, "%d", &pID)
+		req.ParentID = &pID
+	}
+	return req
+}
 
-    // 3. Hash the NEW password
-    newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), 14)
-    if err != nil {
-        http.Error(w, "Failed to process new password", 500)
-        return
-    }
+// unlockedShare is the link an access token opens, 0 if none (or forged / expired)
+func unlockedShare(access string) uint {
+	if access == "" {
+		return 0
+	}
+	token, err := jwtkeys.Parse(access)
+	if err != nil || !token.Valid {
+		return 0
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	id, ok := claims["lnk"].(float64)
+	if claims["typ"] != "share" || !ok {
+		return 0
+	}
+	return uint(id)
+}
 
-    // 4. Update in Database
-    if err := database.DB.Model(&user).Update("password", string(newHash)).Error; err != nil {
-        http.Error(w, "Database error", 500)
-        return
-    }
+// handlePublicShareUnlock checks a share link's password once and returns an
+// access token for the other share endpoints (valid for an hour)
+func handlePublicShareUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
 
-    json.NewEncoder(w).Encode(map[string]string{"status": "password updated successfully"})
-}
\ No newline at end of file
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	link, err := database.UnlockShareLink(req.Token, req.Password)
+	if err != nil { shareError(w, err); return }
+
+	access, err := jwtkeys.Sign(jwt.MapClaims{
+		"typ": "share",
+		"lnk": link.ID,
+		"exp": time.Now().Add(shareAccessTTL).Unix(),
+	})
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"access": access, "expiresIn": int(shareAccessTTL.Seconds())})
+}
+
+// shareError maps share link errors to status codes
+func shareError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrSharePassword):
+		http.Error(w, err.Error(), 401)
+	case errors.Is(err, database.ErrShareExpired), errors.Is(err, database.ErrShareExhausted):
+		http.Error(w, err.Error(), 410)
+	case errors.Is(err, database.ErrShareNotFound):
+		http.Error(w, "Share link not found", 404)
+	default:
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+// handlePublicShare is the only file endpoint without auth: the token is the key.
+// File links answer with a download URL. Folder links list the shared folder,
+// or give a download URL for fileId somewhere inside it.
+func handlePublicShare(w http.ResponseWriter, r *http.Request) {
+	req := readShareRequest(r)
+
+	file, err := database.ResolveShareLink(req.Token, unlockedShare(req.Access), req.FileID)
+	if err != nil { shareError(w, err); return }
+
+	if file.IsFolder {
+		items, err := database.SharedFolderItems(file)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"isFolder": true, "id": file.ID, "name": file.Name, "files": items,
+		})
+		return
+	}
+
+	url, err := storage.Store.GenerateGetURL(file.S3Key, file.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"downloadUrl": url, "name": file.Name, "size": file.Size, "mime_type": file.MimeType,
+	})
+}
+
+// handlePublicShareList lists a subfolder of a shared folder (parentId, null = shared root)
+func handlePublicShareList(w http.ResponseWriter, r *http.Request) {
+	req := readShareRequest(r)
+
+	folder, parentID, items, err := database.ListSharedFolder(req.Token, unlockedShare(req.Access), req.ParentID)
+	if err != nil { shareError(w, err); return }
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id": folder.ID, "name": folder.Name, "parent_id": parentID, "files": items,
+	})
+}
+
+// handlePublicShareZip streams a shared folder (or a subfolder of it) as one zip.
+// Files are stored, not deflated: deliverables are mostly compressed already.
+func handlePublicShareZip(w http.ResponseWriter, r *http.Request) {
+	req := readShareRequest(r)
+
+	folder, entries, err := database.SharedZip(req.Token, unlockedShare(req.Access), req.ParentID)
+	if err != nil { shareError(w, err); return }
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": folder.Name + ".zip"}))
+
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		obj, err := storage.Store.GetObject(entry.S3Key)
+		if err != nil {
+			// Headers are gone already, all we can do is skip it
+			log.Printf("⚠️ Zip: skipping %s: %v\n", entry.Path, err)
+			continue
+		}
+
+		header := &zip.FileHeader{Name: entry.Path, Method: zip.Store, Modified: time.Unix(entry.CreatedAt, 0)}
+		fw, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(fw, obj)
+		}
+		obj.Close()
+		if err != nil {
+			log.Printf("❌ Zip aborted at %s: %v\n", entry.Path, err) // client went away
+			return
+		}
+	}
+	zw.Close()
+}
+
+// --- FILE REQUESTS (upload-only drop links) ---
+
+func handleFileRequests(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	if r.Method == "GET" {
+		reqs, err := database.ListFileRequests(userID, role)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+
+		json.NewEncoder(w).Encode(reqs)
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	var req struct {
+		FolderID          uint     `json:"folderId"`
+		Title             string   `json:"title"`
+		MaxFileSize       int64    `json:"maxFileSize"`       // bytes, 0 = 5GB
+		MaxFiles          int      `json:"maxFiles"`          // 0 = unlimited
+		AllowedExtensions []string `json:"allowedExtensions"` // ["pdf", "docx"], empty = any
+		ExpiresAt         int64    `json:"expiresAt"`         // unix seconds, 0 = never
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	fr, err := database.CreateFileRequest(req.FolderID, userID, role, req.Title, req.MaxFileSize, req.MaxFiles, req.AllowedExtensions, req.ExpiresAt)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(fr)
+}
+
+func handleFileRequestRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.RevokeFileRequest(req.ID, userID, role); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+// dropError maps file request errors to status codes
+func dropError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrRequestNotFound):
+		http.Error(w, err.Error(), 404)
+	case errors.Is(err, database.ErrRequestExpired):
+		http.Error(w, err.Error(), 410)
+	case errors.Is(err, database.ErrRequestFull), errors.Is(err, database.ErrQuotaExceeded):
+		http.Error(w, err.Error(), 403)
+	default:
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+// handlePublicDrop tells the uploader what the link accepts. Never the folder's contents.
+func handlePublicDrop(w http.ResponseWriter, r *http.Request) {
+	fr, folder, err := database.OpenFileRequest(r.URL.Query().Get("token"))
+	if err != nil { dropError(w, err); return }
+
+	maxSize := fr.MaxFileSize
+	if maxSize == 0 { maxSize = storage.MaxSinglePutSize }
+
+	remaining := -1 // unlimited
+	if fr.MaxFiles > 0 { remaining = max(fr.MaxFiles-int(fr.Uploads), 0) }
+
+	var extensions []string
+	if fr.AllowedExtensions != "" { extensions = strings.Split(fr.AllowedExtensions, ",") }
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"title": fr.Title, "folder": folder.Name, "maxFileSize": maxSize,
+		"filesRemaining": remaining, "allowedExtensions": extensions, "expiresAt": fr.ExpiresAt,
+	})
+}
+
+// handlePublicDropInit is handleUploadInit for anonymous visitors of a drop link
+func handlePublicDropInit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	var req struct {
+		Token    string `json:"token"`
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+		Name     string `json:"name"`  // the uploader's
+		Email    string `json:"email"` // optional
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	newFile, err := database.NewDrop(req.Token, req.Filename, req.Size, req.Name, req.Email)
+	if err != nil { dropError(w, err); return }
+
+	var ownerID uint
+	if newFile.UserID != nil { ownerID = *newFile.UserID }
+
+	url, err := startUpload(newFile, ownerID)
+	if errors.Is(err, database.ErrRequestFull) || errors.Is(err, database.ErrRequestNotFound) || errors.Is(err, database.ErrQuotaExceeded) {
+		dropError(w, err); return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploadUrl": url, "fileId": newFile.ID,
+	})
+}
+
+// handlePublicDropFinalize is handleUploadFinalize for a drop link's uploads
+func handlePublicDropFinalize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	var req struct {
+		Token  string `json:"token"`
+		FileID uint   `json:"fileId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	file, err := database.GetPendingDrop(req.Token, req.FileID)
+	if err != nil { dropError(w, err); return }
+
+	var ownerID uint
+	if file.UserID != nil { ownerID = *file.UserID }
+
+	finishUpload(w, file, ownerID)
+}
+
+// handleUsage feeds the storage meter: bytes and files used vs. quota (0 = unlimited).
+// Guests see the pool they all share.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	usage, err := database.GetUsage(userID, role)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(usage)
+}
+
+func handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+    userID := r.Context().Value("userID").(uint)
+    role := r.Context().Value("role").(string) // <--- GET ROLE
+    
+    var req struct {
+        Name     string `json:"name"`
+        ParentID *uint  `json:"parentId"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", 400); return
+    }
+
+    // Determine Visibility
+    // Admin folders = Private (unless specified otherwise, but default private)
+    // Guest folders = Public (Always, so they can see them)
+    isPublic := (role == "guest")
+
+    if err := database.CanWriteFolder(req.ParentID, userID, role); err != nil {
+        http.Error(w, err.Error(), 403); return
+    }
+
+    // Pass isPublic to the DB function
+    folder, err := database.CreateFolder(req.Name, req.ParentID, userID, isPublic)
+    if err != nil {
+        http.Error(w, err.Error(), 400); return
+    }
+
+    json.NewEncoder(w).Encode(folder)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct { Username, Password string }
+	json.NewDecoder(r.Body).Decode(&req)
+
+	user, err := database.Authenticate(req.Username, req.Password, middleware.ClientIP(r))
+	if errors.Is(err, database.ErrUserDisabled) {
+		http.Error(w, err.Error(), 403); return
+	}
+	if errors.Is(err, database.ErrLoginLocked) {
+		http.Error(w, err.Error(), 429); return
+	}
+	if err != nil {
+		http.Error(w, "Invalid credentials", 401); return
+	}
+
+	// 2FA on: no session yet, just a challenge to redeem with a code at /api/login/2fa
+	if user.TOTPEnabled {
+		challenge, err := signChallenge(user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"twoFactorRequired": true, "challenge": challenge})
+		return
+	}
+
+	sendToken(w, r, user.ID, user.Role)
+}
+
+// --- TWO-FACTOR (TOTP) ---
+
+const challengeTTL = 5 * time.Minute
+
+// signChallenge proves the password step passed. It has no session ("sid"),
+// so authMiddleware never accepts it as an access token.
+func signChallenge(id uint) (string, error) {
+	return jwtkeys.Sign(jwt.MapClaims{
+		"sub": id,
+		"typ": "2fa",
+		"exp": time.Now().Add(challengeTTL).Unix(),
+	})
+}
+
+// handleLogin2FA finishes a login with the challenge plus a TOTP or recovery code
+func handleLogin2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"` // 6 digits from the app, or a recovery code
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	token, err := jwtkeys.Parse(req.Challenge)
+	if err != nil || !token.Valid {
+		http.Error(w, "Login expired, start again", 401); return
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	sub, ok := claims["sub"].(float64)
+	if claims["typ"] != "2fa" || !ok {
+		http.Error(w, "Login expired, start again", 401); return
+	}
+
+	user, err := database.ActiveUser(uint(sub))
+	if err != nil {
+		http.Error(w, err.Error(), 403); return
+	}
+	if err := database.CheckSecondFactor(user.ID, req.Code); errors.Is(err, database.ErrLoginLocked) {
+		http.Error(w, err.Error(), 429); return
+	} else if err != nil {
+		http.Error(w, err.Error(), 401); return
+	}
+
+	sendToken(w, r, user.ID, user.Role)
+}
+
+// handle2FA: GET = status, POST = start enrolling (new secret + otpauth:// URI for the app)
+func handle2FA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+
+	if r.Method == "GET" {
+		user, err := database.ActiveUser(userID)
+		if err != nil { http.Error(w, err.Error(), 404); return }
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled": user.TOTPEnabled, "recoveryCodesLeft": database.RemainingRecoveryCodes(userID),
+		})
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	secret, uri, err := database.EnrollTOTP(userID)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret, "uri": uri})
+}
+
+// handle2FAActivate turns 2FA on with a first code from the app; returns the recovery codes
+func handle2FAActivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+
+	var req struct { Code string `json:"code"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	codes, err := database.ActivateTOTP(r.Context().Value("userID").(uint), req.Code)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "enabled", "recoveryCodes": codes})
+}
+
+// handle2FADisable needs the password (accounts that have one) and a current code
+func handle2FADisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+	userID := r.Context().Value("userID").(uint)
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	user, err := database.ActiveUser(userID)
+	if err != nil { http.Error(w, err.Error(), 404); return }
+	if user.Password != "" && bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		http.Error(w, "Current password incorrect", 401); return
+	}
+	if err := database.CheckSecondFactor(userID, req.Code); err != nil {
+		http.Error(w, err.Error(), 401); return
+	}
+
+	if err := database.DisableTOTP(userID); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "disabled"})
+}
+
+// handle2FARecoveryCodes replaces the recovery codes (needs a current code)
+func handle2FARecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+	userID := r.Context().Value("userID").(uint)
+
+	var req struct { Code string `json:"code"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+	if err := database.CheckSecondFactor(userID, req.Code); err != nil {
+		http.Error(w, err.Error(), 401); return
+	}
+
+	codes, err := database.NewRecoveryCodes(userID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"recoveryCodes": codes})
+}
+
+// handleRegister lets anyone create a standard account, if an admin turned it on
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	if !database.RegistrationOpen() {
+		http.Error(w, "Registration is closed", 403); return
+	}
+
+	var req struct { Username, Password string }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	// No email: SSO links accounts by email, so only admins set one
+	user, err := database.CreateUser(req.Username, req.Password, database.RoleUser, "")
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	sendToken(w, r, user.ID, user.Role)
+}
+
+// --- PERSONAL API TOKENS ---
+
+// handleAPITokens: GET = your tokens, POST = new one (the token is only in this response)
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	if r.Method == "GET" {
+		tokens, err := database.ListAPITokens(userID)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+
+		json.NewEncoder(w).Encode(tokens)
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`    // read, write, delete, admin
+		ExpiresAt int64    `json:"expiresAt"` // unix seconds, 0 = never
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	token, raw, err := database.CreateAPIToken(userID, role, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": raw, "apiToken": token})
+}
+
+func handleAPITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.RevokeAPIToken(req.ID, userID); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+// --- SINGLE SIGN-ON (OIDC) ---
+
+const oidcStateCookie = "oidc_state"
+
+// handleOIDCLogin sends the browser to the provider (authorization code + PKCE)
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if sso.Provider == nil {
+		http.Error(w, "Single sign-on is not configured", 404); return
+	}
+
+	state, url, err := sso.Provider.AuthURL()
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	// Pin the login to this browser so a callback URL can't be replayed elsewhere
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie, Value: state, Path: "/api/oidc",
+		MaxAge: 600, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// handleOIDCCallback finishes the login and hands the usual JWT to the frontend
+// in the URL fragment (never sent to a server)
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if sso.Provider == nil {
+		http.Error(w, "Single sign-on is not configured", 404); return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed at the provider: "+e, 401); return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || cookie.Value != q.Get("state") {
+		http.Error(w, "Login state mismatch, start again", 400); return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc", MaxAge: -1})
+
+	id, err := sso.Provider.Exchange(r.Context(), q.Get("state"), q.Get("code"))
+	if err != nil {
+		http.Error(w, err.Error(), 401); return
+	}
+
+	user, err := database.OIDCUser(id.Subject, id.Email, id.EmailVerified, id.Username, id.Role)
+	if errors.Is(err, database.ErrUserDisabled) {
+		http.Error(w, err.Error(), 403); return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	target := os.Getenv("OIDC_SUCCESS_URL") // where the frontend picks the tokens up
+	if target == "" { target = "/" }
+
+	// 2FA on here too: same challenge as a password login, redeemed at /api/login/2fa
+	if user.TOTPEnabled {
+		challenge, err := signChallenge(user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		http.Redirect(w, r, target+"#twoFactorRequired=true&challenge="+challenge, http.StatusFound)
+		return
+	}
+
+	token, refresh, err := startSession(r, user.ID, user.Role)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	http.Redirect(w, r, target+"#token="+token+"&refreshToken="+refresh, http.StatusFound)
+}
+
+func handleGuestLogin(w http.ResponseWriter, r *http.Request) {
+	// Simple Guest Login. In future, check IP Limits here.
+	// We use ID=0 to signify Guest
+	sendToken(w, r, 0, "guest")
+}
+
+func handleUploadInit(w http.ResponseWriter, r *http.Request) {
+	// Extract info from context (set by middleware)
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct { Filename string; Size int64; ParentID *uint `json:"parentId"` }
+	json.NewDecoder(r.Body).Decode(&req)
+
+	name, err := database.CleanName(req.Filename)
+	if err != nil {
+		http.Error(w, "Invalid file name", 400); return
+	}
+	req.Filename = name
+
+	// 🔒 ENFORCE LIMITS
+	if req.Size <= 0 {
+		http.Error(w, "Size must be positive", 400); return
+	}
+	if role == "guest" && req.Size > guestUploadLimit {
+		http.Error(w, "Guest limit exceeded (Max 1GB)", 403); return
+	}
+	if req.Size > storage.MaxSinglePutSize {
+		// 5GB is the S3 single PUT limit; bigger files go through /api/multipart/init
+		http.Error(w, "File too large for a single upload (Max 5GB), use multipart", 400); return
+	}
+	if err := database.CanWriteFolder(req.ParentID, userID, role); err != nil {
+		http.Error(w, err.Error(), 403); return
+	}
+	if err := database.CheckQuota(userID, role, req.Size, 1); err != nil {
+		http.Error(w, err.Error(), 403); return
+	}
+
+	// Save to DB (Pending State)
+	isPublic := (role == "guest") // Guests uploads are public by default? Or private? 
+	// Let's say Guest uploads are PUBLIC so they can share them.
+	
+	var userPtr *uint
+	if userID != 0 { userPtr = &userID }
+
+	newFile := database.FileMetadata{
+		Name: req.Filename, Size: req.Size, 
+		UserID: userPtr, IsPublic: isPublic,
+		ParentID: req.ParentID,
+		Status: "pending",
+	}
+	// Same name in the same folder: this upload becomes the file's next version
+	if existing := database.FindVersionTarget(req.Filename, req.ParentID, userID, role, newFile.IsPublic); existing != nil {
+		newFile.ReplacesID = &existing.ID
+	}
+
+	url, err := startUpload(&newFile, userID)
+	if errors.Is(err, database.ErrQuotaExceeded) { http.Error(w, err.Error(), 403); return }
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploadUrl": url, "fileId": newFile.ID,
+	})
+}
+
+// startUpload saves a pending row under a fresh key and presigns the PUT for it.
+// Shared by normal uploads and file request drops.
+func startUpload(file *database.FileMetadata, userID uint) (string, error) {
+	// Generate UUID Key
+	file.S3Key = fmt.Sprintf("uploads/%s", uuid.New().String())
+
+	if err := database.CreatePending(file); err != nil {
+		return "", err
+	}
+	database.InvalidateCache(file.ParentID, userID)
+
+	// Generate S3 URL with HARD LIMIT
+	return storage.Store.GeneratePutURL(file.S3Key, file.Size) // MUST match exactly
+}
+
+// --- MULTIPART UPLOADS (files over 5GB) ---
+
+func handleMultipartInit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct { Filename string; Size int64; ParentID *uint `json:"parentId"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	name, err := database.CleanName(req.Filename)
+	if err != nil {
+		http.Error(w, "Invalid file name", 400); return
+	}
+	req.Filename = name
+
+	// 🔒 ENFORCE LIMITS
+	if req.Size <= 0 {
+		http.Error(w, "Size must be positive", 400); return
+	}
+	if role == "guest" && req.Size > guestUploadLimit {
+		http.Error(w, "Guest limit exceeded (Max 1GB)", 403); return
+	}
+	if req.Size > storage.MaxObjectSize {
+		http.Error(w, "File too large (Max 5TB)", 400); return
+	}
+	if err := database.CanWriteFolder(req.ParentID, userID, role); err != nil {
+		http.Error(w, err.Error(), 403); return
+	}
+	if err := database.CheckQuota(userID, role, req.Size, 1); err != nil {
+		http.Error(w, err.Error(), 403); return
+	}
+
+	uniqueKey := fmt.Sprintf("uploads/%s", uuid.New().String())
+
+	uploadID, err := storage.Store.CreateMultipartUpload(uniqueKey)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	var userPtr *uint
+	if userID != 0 { userPtr = &userID }
+
+	newFile := database.FileMetadata{
+		Name: req.Filename, S3Key: uniqueKey, Size: req.Size,
+		UserID: userPtr, IsPublic: (role == "guest"),
+		ParentID: req.ParentID,
+		Status: "pending",
+		UploadID: uploadID,
+		PartSize: storage.PartSize(req.Size),
+	}
+	if existing := database.FindVersionTarget(req.Filename, req.ParentID, userID, role, newFile.IsPublic); existing != nil {
+		newFile.ReplacesID = &existing.ID
+	}
+	if err := database.CreatePending(&newFile); err != nil {
+		storage.Store.AbortMultipartUpload(uniqueKey, uploadID) // Nothing points at it, don't leave it billing
+		if errors.Is(err, database.ErrQuotaExceeded) { http.Error(w, err.Error(), 403); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	database.InvalidateCache(req.ParentID, userID)
+
+	parts, err := presignParts(&newFile, storage.PlanParts(newFile.Size, newFile.PartSize))
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fileId": newFile.ID, "partSize": newFile.PartSize, "parts": parts,
+	})
+}
+
+// One presigned URL per chunk, each locked to its exact size
+type partURL struct {
+	PartNumber int32  `json:"partNumber"`
+	Size       int64  `json:"size"`
+	URL        string `json:"url"`
+}
+
+func presignParts(file *database.FileMetadata, parts []storage.Part) ([]partURL, error) {
+	urls := []partURL{}
+	for _, p := range parts {
+		url, err := storage.Store.GeneratePartURL(file.S3Key, file.UploadID, p.Number, p.Size)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, partURL{PartNumber: p.Number, Size: p.Size, URL: url})
+	}
+	return urls, nil
+}
+
+// handleMultipartStatus is the "resume" call: what has landed so far,
+// plus fresh URLs for only the parts still missing.
+func handleMultipartStatus(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var fileID uint
+	fmt.Sscanf(r.URL.Query().Get("fileId"), "%d", &fileID)
+
+	file, err := database.GetPendingUpload(fileID, userID, role)
+	if err != nil || file.UploadID == "" {
+		http.Error(w, "File not found or access denied", 404); return
+	}
+
+	uploaded, err := storage.Store.ListParts(file.S3Key, file.UploadID)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Upload expired, start again", 410); return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	landed := make(map[int32]storage.UploadedPart)
+	for _, p := range uploaded {
+		landed[p.Number] = p
+	}
+
+	type donePart struct {
+		PartNumber int32  `json:"partNumber"`
+		Size       int64  `json:"size"`
+		ETag       string `json:"etag"`
+	}
+	done := []donePart{}
+	var missing []storage.Part
+	var bytesUploaded int64
+
+	for _, p := range storage.PlanParts(file.Size, file.PartSize) {
+		// A part only counts if it's the full planned size
+		if u, ok := landed[p.Number]; ok && u.Size == p.Size {
+			done = append(done, donePart{PartNumber: p.Number, Size: p.Size, ETag: u.ETag})
+			bytesUploaded += p.Size
+		} else {
+			missing = append(missing, p)
+		}
+	}
+
+	missingURLs, err := presignParts(file, missing)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	// Someone is working on it, keep it away from the cleanup task
+	database.TouchUpload(file)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fileId": file.ID, "name": file.Name, "size": file.Size, "parentId": file.ParentID,
+		"partSize": file.PartSize, "bytesUploaded": bytesUploaded,
+		"uploadedParts": done, "missingParts": missingURLs,
+	})
+}
+
+// handleMultipartPending lists unfinished uploads, so the client can offer to resume them
+func handleMultipartPending(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	files, err := database.ListPendingUploads(userID, role)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(files)
+}
+
+func handleMultipartComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct {
+		FileID uint `json:"fileId"`
+		Parts  []struct {
+			PartNumber int32  `json:"partNumber"`
+			ETag       string `json:"etag"`
+		} `json:"parts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	file, err := database.GetPendingUpload(req.FileID, userID, role)
+	if err != nil || file.UploadID == "" {
+		http.Error(w, "File not found or access denied", 404); return
+	}
+
+	// S3 wants the parts in ascending order
+	var parts []storage.CompletedPart
+	for _, p := range req.Parts {
+		parts = append(parts, storage.CompletedPart{Number: p.PartNumber, ETag: p.ETag})
+	}
+
+	// A resumed client may not have every ETag any more; ask the store instead
+	if len(parts) == 0 {
+		uploaded, err := storage.Store.ListParts(file.S3Key, file.UploadID)
+		if err != nil {
+			http.Error(w, "Could not list parts: "+err.Error(), 400); return
+		}
+		for _, p := range uploaded {
+			parts = append(parts, storage.CompletedPart{Number: p.Number, ETag: p.ETag})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+
+	if err := storage.Store.CompleteMultipartUpload(file.S3Key, file.UploadID, parts); err != nil {
+		http.Error(w, "Could not complete upload: "+err.Error(), 400); return
+	}
+
+	// Same checks as a single PUT (size, content type)
+	if err := database.CompleteUpload(file); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	database.InvalidateCache(file.ParentID, userID)
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func handleMultipartAbort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var req struct { FileID uint `json:"fileId"` }
+	json.NewDecoder(r.Body).Decode(&req)
+
+	file, err := database.GetPendingUpload(req.FileID, userID, role)
+	if err != nil || file.UploadID == "" {
+		http.Error(w, "File not found or access denied", 404); return
+	}
+
+	// Frees the parts already stored (S3 bills for them until aborted)
+	if err := storage.Store.AbortMultipartUpload(file.S3Key, file.UploadID); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	database.BatchDelete([]uint{file.ID}, nil)
+	database.InvalidateCache(file.ParentID, userID)
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "aborted"})
+}
+
+func handleUploadFinalize(w http.ResponseWriter, r *http.Request) {
+    var req struct { FileID uint `json:"fileId"` }
+    json.NewDecoder(r.Body).Decode(&req)
+
+    // 1. Get UserID to ensure they own the file (security check)
+    userID := r.Context().Value("userID").(uint)
+    role := r.Context().Value("role").(string)
+
+    // Admin can finalize anything; users only their own file.
+    // Guests: ideally we need a session ID to fully secure this,
+    // but for now, checking ID exists is okay.
+    file, err := database.GetPendingUpload(req.FileID, userID, role)
+    if err != nil {
+        http.Error(w, "File not found or access denied", 404)
+        return
+    }
+
+    // 2. Check the object really landed, then flip the switch
+    finishUpload(w, file, userID)
+}
+
+// finishUpload verifies a single-PUT upload and answers the client
+func finishUpload(w http.ResponseWriter, file *database.FileMetadata, userID uint) {
+    if err := database.CompleteUpload(file); err != nil {
+        if errors.Is(err, database.ErrUploadMissing) {
+            http.Error(w, err.Error(), 409) // Not there (yet), client can retry the PUT
+            return
+        }
+        http.Error(w, err.Error(), 400)
+        return
+    }
+    database.InvalidateCache(file.ParentID, userID)
+
+    json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func handleListFiles(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(uint)
+    role := r.Context().Value("role").(string)
+    
+    // Parse Parent ID from Query (e.g., ?parentId=5)
+    // If empty or "null", it means Root.
+    rawParentID := r.URL.Query().Get("parentId")
+    
+    var parentID *uint
+    if rawParentID != "" && rawParentID != "null" {
+        // Convert string to uint... (simplified for brevity)
+        var pID uint
+        fmt.Sscanf(rawParentID, "%d", &pID)
+        parentID = &pID
+    }
+
+    files, err := database.GetFolderContent(parentID, userID, role)
+    if errors.Is(err, database.ErrFolderNotFound) {
+        http.Error(w, err.Error(), 404); return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), 500); return
+    }
+    
+    json.NewEncoder(w).Encode(files)
+}
+
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(uint)
+	role := r.Context().Value("role").(string)
+
+	var fileID uint
+	fmt.Sscanf(r.URL.Query().Get("id"), "%d", &fileID)
+
+	// 🔒 Same visibility as listings. Anything the caller can't see is a plain
+	// 404 so IDs can't be probed; trashed and unfinished files aren't served either.
+	file, err := database.GetReadableItem(fileID, userID, role)
+	if err != nil || file.IsTrash || file.Status != "completed" {
+		log.Printf("🚫 Download denied: file=%d user=%d role=%s ip=%s\n", fileID, userID, role, r.RemoteAddr)
+		http.Error(w, "Not found", 404); return
+	}
+	if file.IsFolder {
+		http.Error(w, "Folders can't be downloaded directly", 400); return
+	}
+
+	// Generate URL
+	url, err := storage.Store.GenerateGetURL(file.S3Key, file.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+
+	log.Printf("⬇️ Download: file=%d user=%d role=%s ip=%s\n", file.ID, userID, role, r.RemoteAddr)
+	json.NewEncoder(w).Encode(map[string]string{"downloadUrl": url})
+}
+
+// --- HELPERS ---
+
+// sendToken starts a session: a short-lived access token plus the refresh
+// token that renews it (POST /api/refresh)
+func sendToken(w http.ResponseWriter, r *http.Request, id uint, role string) {
+	token, refresh, err := startSession(r, id, role)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	sendTokens(w, token, refresh)
+}
+
+func sendTokens(w http.ResponseWriter, token string, refresh string) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": token, "refreshToken": refresh, "expiresIn": int(accessTokenTTL.Seconds()),
+	})
+}
+
+func startSession(r *http.Request, id uint, role string) (string, string, error) {
+	session, refresh, err := database.CreateSession(id, role, middleware.ClientIP(r), r.UserAgent())
+	if err != nil {
+		return "", "", err
+	}
+	token, err := signToken(id, role, session.ID)
+	return token, refresh, err
+}
+
+func signToken(id uint, role string, sessionID uint) (string, error) {
+	return jwtkeys.Sign(jwt.MapClaims{
+		"sub": id,
+		"role": role,
+		"sid": sessionID,
+		"exp": time.Now().Add(accessTokenTTL).Unix(),
+	})
+}
+
+// handleJWKS publishes the verification keys (only with Ed25519 / RSA signing, never the HMAC secret)
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" { http.Error(w, "GET only", 405); return }
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(jwtkeys.JWKS())
+}
+
+// handleRefresh rotates a refresh token and hands out a fresh access token
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	var req struct { RefreshToken string `json:"refreshToken"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	session, refresh, err := database.RefreshSession(req.RefreshToken, middleware.ClientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), 401); return
+	}
+
+	role := session.Role
+	if role != "guest" {
+		user, err := database.ActiveUser(session.UserID)
+		if err != nil {
+			database.RevokeSession(session.ID, session.UserID)
+			http.Error(w, err.Error(), 401); return
+		}
+		role = user.Role
+	}
+
+	token, err := signToken(session.UserID, role, session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	sendTokens(w, token, refresh)
+}
+
+// --- SESSIONS ---
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+
+	userID := r.Context().Value("userID").(uint)
+	sessionID := r.Context().Value("sessionID").(uint)
+
+	database.RevokeSession(sessionID, userID)
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out"})
+}
+
+// handleLogoutAll ends every session of the account, this one included
+func handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+
+	if err := database.RevokeSessions(r.Context().Value("userID").(uint), 0); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out everywhere"})
+}
+
+// handleSessions lists the account's active sessions (device, IP, last use)
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+
+	sessions, err := database.ListSessions(r.Context().Value("userID").(uint), r.Context().Value("sessionID").(uint))
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func handleSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Unauthorized: Account required", 403); return
+	}
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.RevokeSession(req.ID, r.Context().Value("userID").(uint)); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+func ensureAdminExists() {
+	var count int64
+	database.DB.Model(&database.User{}).Count(&count)
+	if count == 0 {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("admin123"), 14)
+		database.DB.Create(&database.User{Username: "admin", Password: string(hash), Role: database.RoleAdmin})
+		log.Println("⚠️ Created default user: admin / admin123")
+	}
+}
+
+// --- MIDDLEWARE ---
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			http.Error(w, "Missing Auth Token", 401); return
+		}
+		
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+
+		// Personal API tokens: same account, limited to the token's scopes
+		if strings.HasPrefix(tokenString, database.APITokenPrefix) {
+			apiToken, err := database.AuthenticateAPIToken(tokenString)
+			if err != nil {
+				http.Error(w, "Invalid Token", 401); return
+			}
+			user, err := database.ActiveUser(apiToken.UserID)
+			if err != nil {
+				http.Error(w, "Invalid Token", 401); return
+			}
+			scope := requiredScope(r)
+			if scope == "" {
+				http.Error(w, "Not available with an API token, log in instead", 403); return
+			}
+			if !apiToken.HasScope(scope) {
+				http.Error(w, "API token lacks the '"+scope+"' scope", 403); return
+			}
+
+			ctx := context.WithValue(r.Context(), "userID", user.ID)
+			ctx = context.WithValue(ctx, "role", user.Role)
+			ctx = context.WithValue(ctx, "sessionID", uint(0))
+			next(w, r.WithContext(ctx))
+			return
+		}
+
+		// Signature, session and the account's current role
+		userID, role, sid, err := middleware.AccessToken(tokenString)
+		if errors.Is(err, database.ErrSessionInvalid) {
+			http.Error(w, "Session expired or revoked", 401); return
+		}
+		if err != nil {
+			http.Error(w, "Invalid Token", 401); return
+		}
+
+		ctx := context.WithValue(r.Context(), "userID", userID)
+		ctx = context.WithValue(ctx, "role", role)
+		ctx = context.WithValue(ctx, "sessionID", sid)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requiredScope is the API token scope a request needs ("" = log in instead:
+// tokens can't mint more tokens, manage sessions, 2FA or the account's password)
+func requiredScope(r *http.Request) string {
+	switch p := r.URL.Path; {
+	case strings.HasPrefix(p, "/api/tokens"), strings.HasPrefix(p, "/api/sessions"), strings.HasPrefix(p, "/api/logout"), strings.HasPrefix(p, "/api/2fa"),
+		p == "/api/account/password", p == "/api/admin/update-password":
+		return ""
+	case strings.HasPrefix(p, "/api/admin/"):
+		return database.ScopeAdmin
+	case r.Method == "DELETE", p == "/api/delete", p == "/api/soft-delete", p == "/api/trash/empty":
+		return database.ScopeDelete
+	case r.Method == "GET" || r.Method == "HEAD":
+		return database.ScopeRead
+	}
+	return database.ScopeWrite
+}
+
+// handleUpdatePassword changes the caller's own password (any account, not guests)
+func handleUpdatePassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "POST only", 405)
+        return
+    }
+
+    userID := r.Context().Value("userID").(uint)
+    role := r.Context().Value("role").(string)
+
+    // Guests have no account to change
+    if role == "guest" {
+        http.Error(w, "Unauthorized: Account required", 403)
+        return
+    }
+
+    var req struct {
+        OldPassword string `json:"oldPassword"`
+        NewPassword string `json:"newPassword"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", 400)
+        return
+    }
+
+    // 1. Fetch the user from the DB
+    var user database.User
+    if err := database.DB.First(&user, userID).Error; err != nil {
+        http.Error(w, "User not found", 404)
+        return
+    }
+
+    // 2. Verify the OLD password
+    err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.OldPassword))
+    if err != nil {
+        http.Error(w, "Current password incorrect", 401)
+        return
+    }
+
+    // 3. Hash & store the NEW password (other devices get logged out)
+    if err := database.SetPassword(user.ID, req.NewPassword, r.Context().Value("sessionID").(uint)); err != nil {
+        http.Error(w, err.Error(), 400)
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"status": "password updated successfully"})
+}
+
+// --- USER MANAGEMENT (admin only) ---
+
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if r.Context().Value("role").(string) != "admin" {
+		http.Error(w, "Unauthorized: Admin access required", 403)
+		return false
+	}
+	return true
+}
+
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) { return }
+
+	if r.Method == "GET" {
+		users, err := database.ListUsers()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+
+		json.NewEncoder(w).Encode(users)
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`  // "user" (default) or "admin"
+		Email    string `json:"email"` // optional, SSO logins with this verified email link to the account
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+	if req.Role == "" { req.Role = database.RoleUser }
+
+	user, err := database.CreateUser(req.Username, req.Password, req.Role, req.Email)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(user)
+}
+
+func handleAdminUserUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if !requireAdmin(w, r) { return }
+
+	var req struct {
+		ID         uint    `json:"id"`
+		Role       *string `json:"role"`       // omit to keep
+		Disabled   *bool   `json:"disabled"`   // omit to keep
+		Email      *string `json:"email"`      // omit to keep, "" to clear
+		QuotaBytes *int64  `json:"quotaBytes"` // omit to keep, -1 = role default, 0 = unlimited
+		QuotaFiles *int64  `json:"quotaFiles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	user, err := database.UpdateUser(req.ID, req.Role, req.Disabled, req.Email)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	if err := database.SetUserQuota(user.ID, req.QuotaBytes, req.QuotaFiles); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	database.DB.First(user, user.ID)
+
+	json.NewEncoder(w).Encode(user)
+}
+
+func handleAdminUserDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if !requireAdmin(w, r) { return }
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+	if req.ID == r.Context().Value("userID").(uint) {
+		http.Error(w, "You cannot delete your own account", 400); return
+	}
+
+	if err := database.DeleteUser(req.ID); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// --- GROUPS ---
+
+// handleGroups lists group names for picking a grant target (any account)
+func handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Value("role").(string) == "guest" {
+		http.Error(w, "Guests cannot share", 403); return
+	}
+
+	groups, err := database.ListGroups()
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	json.NewEncoder(w).Encode(groups)
+}
+
+func handleAdminGroups(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) { return }
+
+	if r.Method == "GET" {
+		handleGroups(w, r)
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	var req struct { Name string `json:"name"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	group, err := database.CreateGroup(req.Name)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	json.NewEncoder(w).Encode(group)
+}
+
+func handleAdminGroupDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if !requireAdmin(w, r) { return }
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.DeleteGroup(req.ID); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// handleAdminGroupMembers: GET ?id= lists members, POST {groupId, username} adds one
+func handleAdminGroupMembers(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) { return }
+
+	if r.Method == "GET" {
+		var groupID uint
+		fmt.Sscanf(r.URL.Query().Get("id"), "%d", &groupID)
+
+		users, err := database.ListGroupMembers(groupID)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+
+		json.NewEncoder(w).Encode(users)
+		return
+	}
+	if r.Method != "POST" { http.Error(w, "GET or POST only", 405); return }
+
+	var req struct {
+		GroupID  uint   `json:"groupId"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.AddGroupMember(req.GroupID, req.Username); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "added"})
+}
+
+func handleAdminGroupMemberRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if !requireAdmin(w, r) { return }
+
+	var req struct {
+		GroupID uint `json:"groupId"`
+		UserID  uint `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.RemoveGroupMember(req.GroupID, req.UserID); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+}
+
+func handleAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if !requireAdmin(w, r) { return }
+
+	var req struct {
+		ID          uint   `json:"id"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.SetPassword(req.ID, req.NewPassword, 0); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "password reset"})
+}
+
+// handleAdminReset2FA turns someone's 2FA off (lost phone and recovery codes)
+func handleAdminReset2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST only", 405); return }
+	if !requireAdmin(w, r) { return }
+
+	var req struct { ID uint `json:"id"` }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400); return
+	}
+
+	if err := database.DisableTOTP(req.ID); err != nil {
+		http.Error(w, err.Error(), 404); return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "2fa reset"})
+}
+
+func handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) { return }
+
+	if r.Method == "POST" {
+		var req struct { AllowRegistration bool `json:"allowRegistration"` }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400); return
+		}
+		if err := database.SetRegistrationOpen(req.AllowRegistration); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"allowRegistration": database.RegistrationOpen()})
+}
+
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+	role := r.Context().Value("role").(string)
+	if role != "admin" {
+		http.Error(w, "Unauthorized: Admin access required", 403)
+		return
+	}
+
+	// Dry run unless explicitly asked otherwise, and deleting needs a POST
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+	if !dryRun && r.Method != "POST" {
+		http.Error(w, "POST only", 405)
+		return
+	}
+
+	grace := 24 * time.Hour
+	if raw := r.URL.Query().Get("graceHours"); raw != "" {
+		var hours int
+		if _, err := fmt.Sscanf(raw, "%d", &hours); err != nil || hours < 0 {
+			http.Error(w, "Invalid graceHours", 400)
+			return
+		}
+		grace = time.Duration(hours) * time.Hour
+	}
+
+	report, err := database.Reconcile(dryRun, grace)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"s3-drive/internal/database"
+	"s3-drive/internal/jwtkeys"
+	"s3-drive/internal/storage"
+)
+
+// testServer points the database and local storage at a temp dir
+func testServer(t *testing.T) {
+	t.Helper()
+	t.Setenv("DATABASE_URL", "")
+	t.Setenv("STORAGE_BACKEND", "local")
+	t.Chdir(t.TempDir())
+	database.Connect()
+	storage.Connect()
+	jwtkeys.Load()
+}
+
+func TestHandleDownloadPermissions(t *testing.T) {
+	testServer(t)
+
+	owner := uint(2)
+	add := func(f database.FileMetadata) uint {
+		if f.Status == "" {
+			f.Status = "completed"
+		}
+		if err := database.DB.Create(&f).Error; err != nil {
+			t.Fatal(err)
+		}
+		return f.ID
+	}
+	private := add(database.FileMetadata{Name: "private.txt", S3Key: "uploads/p", UserID: &owner})
+	public := add(database.FileMetadata{Name: "public.txt", S3Key: "uploads/pub", UserID: &owner, IsPublic: true})
+	trashed := add(database.FileMetadata{Name: "trashed.txt", S3Key: "uploads/t", UserID: &owner, IsTrash: true})
+	pending := add(database.FileMetadata{Name: "pending.txt", S3Key: "uploads/u", UserID: &owner, Status: "pending"})
+	folder := add(database.FileMetadata{Name: "folder", IsFolder: true, UserID: &owner})
+
+	tests := []struct {
+		name   string
+		id     uint
+		userID uint
+		role   string
+		want   int
+	}{
+		{"owner", private, owner, "user", 200},
+		{"admin", private, 1, "admin", 200},
+		{"unrelated user", private, 3, "user", 404},
+		{"guest", private, 0, "guest", 404},
+		{"guest on a public file", public, 0, "guest", 200},
+		{"user on a public file", public, 3, "user", 200},
+		{"owner on a trashed file", trashed, owner, "user", 404},
+		{"admin on a trashed file", trashed, 1, "admin", 404},
+		{"owner on a pending upload", pending, owner, "user", 404},
+		{"admin on a pending upload", pending, 1, "admin", 404},
+		{"folder", folder, owner, "user", 400},
+		{"missing", 9999, 1, "admin", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", fmt.Sprintf("/api/download?id=%d", tt.id), nil)
+			ctx := context.WithValue(r.Context(), "userID", tt.userID)
+			ctx = context.WithValue(ctx, "role", tt.role)
+			w := httptest.NewRecorder()
+
+			handleDownload(w, r.WithContext(ctx))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusOK && w.Body.Len() == 0 {
+				t.Error("no download URL in the response")
+			}
+		})
+	}
+}
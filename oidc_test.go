@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"s3-drive/internal/database"
+	"s3-drive/internal/jwtkeys"
+	"s3-drive/internal/sso"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, JWKS, an /authorize that
+// approves right away, and a /token endpoint that checks PKCE and signs an ID
+// token carrying whatever claims the test set
+type mockIssuer struct {
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	auth   url.Values // The last /authorize request
+	claims map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.srv.URL,
+			"authorization_endpoint":                m.srv.URL + "/authorize",
+			"token_endpoint":                        m.srv.URL + "/token",
+			"jwks_uri":                              m.srv.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		m.auth = r.URL.Query()
+		http.Redirect(w, r, m.auth.Get("redirect_uri")+"?code=code1&state="+url.QueryEscape(m.auth.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if m.auth.Get("code_challenge_method") != "S256" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.auth.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, 400)
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss": m.srv.URL, "aud": m.auth.Get("client_id"), "nonce": m.auth.Get("nonce"),
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		idToken.Header["kid"] = "test"
+		signed, _ := idToken.SignedString(m.key)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func TestOIDCLogin(t *testing.T) {
+	testServer(t)
+	issuer := newMockIssuer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/oidc/login", handleOIDCLogin)
+	mux.HandleFunc("/api/oidc/callback", handleOIDCCallback)
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {})
+	app := httptest.NewServer(mux)
+	defer app.Close()
+
+	t.Setenv("OIDC_ISSUER_URL", issuer.srv.URL)
+	t.Setenv("OIDC_CLIENT_ID", "drive")
+	t.Setenv("OIDC_REDIRECT_URL", app.URL+"/api/oidc/callback")
+	t.Setenv("OIDC_ADMIN_GROUPS", "ops")
+	t.Setenv("OIDC_SUCCESS_URL", "/done")
+	sso.Connect()
+	defer func() { sso.Provider = nil }()
+
+	// login runs the whole redirect dance and returns the status and the user the token
+	// is for (0 if there's none); fragment is what the frontend got after the #
+	var fragment url.Values
+	login := func(claims map[string]interface{}) (int, uint) {
+		issuer.claims = claims
+		jar, _ := cookiejar.New(nil)
+		var final *url.URL
+		client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			final = req.URL
+			return nil
+		}}
+		res, err := client.Get(app.URL + "/api/oidc/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 || final == nil || final.Path != "/done" {
+			return res.StatusCode, 0
+		}
+
+		fragment, _ = url.ParseQuery(final.Fragment)
+		if fragment.Get("token") == "" {
+			return 200, 0
+		}
+		token, err := jwtkeys.Parse(fragment.Get("token"))
+		if err != nil {
+			t.Fatalf("bad token in redirect: %v", err)
+		}
+		return 200, uint(token.Claims.(jwt.MapClaims)["sub"].(float64))
+	}
+
+	alice, err := database.CreateUser("alice", "password1", database.RoleUser, "Alice@Corp.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noEmail, _ := database.CreateUser("bob", "password1", database.RoleUser, "")
+
+	t.Run("verified email links the admin-set account", func(t *testing.T) {
+		code, id := login(map[string]interface{}{"sub": "sub-alice", "email": "alice@corp.io", "email_verified": true})
+		if code != 200 || id != alice.ID {
+			t.Fatalf("got %d user %d, want 200 user %d", code, id, alice.ID)
+		}
+		code, id = login(map[string]interface{}{"sub": "sub-alice"})
+		if code != 200 || id != alice.ID {
+			t.Fatalf("second login by subject: got %d user %d", code, id)
+		}
+	})
+
+	t.Run("unverified email never links", func(t *testing.T) {
+		database.UpdateUser(alice.ID, nil, nil, strPtr(""))
+		database.DB.Model(&database.User{}).Where("id = ?", noEmail.ID).Update("email", "bob@corp.io")
+		code, id := login(map[string]interface{}{"sub": "sub-mallory", "email": "bob@corp.io", "email_verified": false})
+		if code != 200 || id == noEmail.ID || id == 0 {
+			t.Fatalf("got %d user %d, want a new account", code, id)
+		}
+		var u database.User
+		database.DB.First(&u, id)
+		if u.Email != "" || u.Role != database.RoleUser {
+			t.Errorf("new account email %q role %q, want no email and role user", u.Email, u.Role)
+		}
+	})
+
+	t.Run("provider groups map to admin", func(t *testing.T) {
+		code, id := login(map[string]interface{}{"sub": "sub-ops", "preferred_username": "opsy", "groups": []string{"dev", "ops"}})
+		var u database.User
+		database.DB.First(&u, id)
+		if code != 200 || u.Role != database.RoleAdmin || u.Username != "opsy" {
+			t.Fatalf("got %d %q %q, want 200 opsy admin", code, u.Username, u.Role)
+		}
+	})
+
+	t.Run("callback without the state cookie", func(t *testing.T) {
+		res, err := http.Get(app.URL + "/api/oidc/callback?code=code1&state=forged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("got %d, want 400", res.StatusCode)
+		}
+	})
+
+	t.Run("2FA account gets a challenge, not a session", func(t *testing.T) {
+		carol, _ := database.CreateUser("carol", "password1", database.RoleUser, "")
+		database.DB.Model(carol).Updates(map[string]interface{}{"oidc_subject": "sub-carol", "totp_enabled": true, "totp_secret": "JBSWY3DPEHPK3PXP"})
+		codes, _ := database.NewRecoveryCodes(carol.ID)
+
+		code, id := login(map[string]interface{}{"sub": "sub-carol"})
+		if code != 200 || id != 0 || fragment.Get("twoFactorRequired") != "true" || fragment.Get("challenge") == "" {
+			t.Fatalf("got %d user %d fragment %v, want a 2FA challenge", code, id, fragment)
+		}
+
+		body := strings.NewReader(fmt.Sprintf(`{"challenge":%q,"code":%q}`, fragment.Get("challenge"), codes[0]))
+		w := httptest.NewRecorder()
+		handleLogin2FA(w, httptest.NewRequest("POST", "/api/login/2fa", body))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "refreshToken") {
+			t.Errorf("second step: %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("disabled account", func(t *testing.T) {
+		database.UpdateUser(alice.ID, nil, boolPtr(true), nil)
+		if code, _ := login(map[string]interface{}{"sub": "sub-alice"}); code != 403 {
+			t.Errorf("got %d, want 403", code)
+		}
+	})
+
+	if !strings.Contains(issuer.auth.Get("scope"), "openid") {
+		t.Errorf("scope %q lacks openid", issuer.auth.Get("scope"))
+	}
+}
+
+func strPtr(s string) *string { return &s }
+func boolPtr(b bool) *bool    { return &b }
+
+func TestCreateUserEmail(t *testing.T) {
+	testServer(t)
+
+	if _, err := database.CreateUser("carol", "password1", database.RoleUser, "carol@corp.io"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		email   string
+		wantErr bool
+	}{
+		{"no email", "", false},
+		{"new address", "dave@corp.io", false},
+		{"taken, other case", "CAROL@corp.io", true},
+		{"not an address", "carol", true},
+		{"display name form", "Carol <x@corp.io>", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := database.CreateUser(fmt.Sprintf("user%d", i), "password1", database.RoleUser, tt.email)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}